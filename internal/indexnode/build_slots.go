@@ -0,0 +1,136 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/milvus-io/milvus/pkg/log"
+)
+
+// buildSlots is a counting semaphore bounding the index builds running concurrently,
+// it's shared by the task scheduler and the external reservations. The capacity can be resized at runtime.
+type buildSlots struct {
+	mu       sync.Mutex
+	capacity int
+	used     int
+	// waiting is the number of the acquirers blocked until a slot is free
+	waiting int
+	// released is closed and replaced once a slot is released or the capacity grows, to wake up the waiters
+	released chan struct{}
+}
+
+func newBuildSlots(capacity int) *buildSlots {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &buildSlots{capacity: capacity, released: make(chan struct{})}
+}
+
+// acquire blocks until a slot is free or ctx is done,
+// the returned release func is safe to be called more than once.
+func (s *buildSlots) acquire(ctx context.Context) (func(), error) {
+	for {
+		s.mu.Lock()
+		if s.used < s.capacity {
+			s.used++
+			s.mu.Unlock()
+			break
+		}
+		released := s.released
+		s.waiting++
+		s.mu.Unlock()
+		var err error
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-released:
+		}
+		s.mu.Lock()
+		s.waiting--
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.used--
+			s.wakeUpLocked()
+		})
+	}, nil
+}
+
+// resize changes the capacity, the slots acquired beyond a shrunk capacity are kept until they are released,
+// and no more slot is acquired until the used slots drop below the new capacity.
+func (s *buildSlots) resize(capacity int) {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = capacity
+	s.wakeUpLocked()
+}
+
+func (s *buildSlots) getCapacity() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.capacity
+}
+
+// free returns the number of the slots left for new tasks, taking the slots used, the blocked acquirers
+// and the queued tasks which are going to acquire a slot. It's 0 if the slots are oversubscribed.
+func (s *buildSlots) free(queued int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	free := s.capacity - s.used - s.waiting - queued
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+func (s *buildSlots) wakeUpLocked() {
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// SetMaxConcurrency sets the number of the index builds running concurrently, the non-positive n is taken as 1.
+// The builds running beyond a lowered limit go on until they are done.
+func (i *IndexNode) SetMaxConcurrency(n int) {
+	i.sched.buildSlots.resize(n)
+	log.Info("IndexNode set max build concurrency", zap.Int("concurrency", n), zap.Int("maxConcurrency", i.MaxConcurrency()))
+}
+
+// MaxConcurrency returns the number of the index builds allowed to run concurrently.
+func (i *IndexNode) MaxConcurrency() int {
+	return i.sched.buildSlots.getCapacity()
+}
+
+// ReserveBuildSlot blocks until a build slot of the index node is free, or ctx is done.
+// The reserved slot is taken from the same capacity as the index build tasks,
+// so the tasks scheduled are held back until the slot is released by the returned func.
+func (i *IndexNode) ReserveBuildSlot(ctx context.Context) (release func(), err error) {
+	return i.sched.buildSlots.acquire(ctx)
+}
@@ -0,0 +1,182 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/milvus-io/milvus/pkg/util/paramtable"
+)
+
+func TestIndexNode_ReserveBuildSlot(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.BuildParallel.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.BuildParallel.Key)
+	in := newTestIndexNode()
+
+	release1, err := in.ReserveBuildSlot(context.TODO())
+	assert.NoError(t, err)
+	release2, err := in.ReserveBuildSlot(context.TODO())
+	assert.NoError(t, err)
+
+	// no slot is free, the reservation is cancelled with the context
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	_, err = in.ReserveBuildSlot(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the blocked reservation succeeds once a slot is released
+	reserved := make(chan func())
+	go func() {
+		release, err := in.ReserveBuildSlot(context.TODO())
+		assert.NoError(t, err)
+		reserved <- release
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("slot reserved while none is free")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release1()
+	// releasing twice doesn't free another slot
+	release1()
+	release3 := <-reserved
+	_, err = in.ReserveBuildSlot(ctx)
+	assert.Error(t, err)
+
+	release2()
+	release3()
+	release, err := in.ReserveBuildSlot(context.TODO())
+	assert.NoError(t, err)
+	release()
+}
+
+func TestIndexNode_SetMaxConcurrency(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.BuildParallel.Key, "1")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.BuildParallel.Key)
+	in := newTestIndexNode()
+	assert.Equal(t, 1, in.MaxConcurrency())
+
+	reserve := func() <-chan func() {
+		reserved := make(chan func(), 1)
+		go func() {
+			release, err := in.ReserveBuildSlot(context.TODO())
+			assert.NoError(t, err)
+			reserved <- release
+		}()
+		return reserved
+	}
+	assertBlocked := func(reserved <-chan func()) {
+		select {
+		case <-reserved:
+			t.Fatal("slot reserved while none is free")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	t.Run("resize up", func(t *testing.T) {
+		release1, err := in.ReserveBuildSlot(context.TODO())
+		assert.NoError(t, err)
+		reserved := reserve()
+		assertBlocked(reserved)
+
+		// the blocked reservation succeeds once the limit is raised
+		in.SetMaxConcurrency(2)
+		assert.Equal(t, 2, in.MaxConcurrency())
+		release2 := <-reserved
+		release1()
+		release2()
+	})
+
+	t.Run("resize down", func(t *testing.T) {
+		in.SetMaxConcurrency(3)
+		releases := make([]func(), 0, 3)
+		for idx := 0; idx < 3; idx++ {
+			release, err := in.ReserveBuildSlot(context.TODO())
+			assert.NoError(t, err)
+			releases = append(releases, release)
+		}
+
+		// the in-flight reservations are kept beyond the lowered limit
+		in.SetMaxConcurrency(1)
+		assert.Equal(t, 1, in.MaxConcurrency())
+		reserved := reserve()
+		releases[0]()
+		releases[1]()
+		assertBlocked(reserved)
+		releases[2]()
+		release := <-reserved
+		release()
+	})
+
+	in.SetMaxConcurrency(0)
+	assert.Equal(t, 1, in.MaxConcurrency())
+}
+
+func TestBuildSlots_free(t *testing.T) {
+	slots := newBuildSlots(3)
+	assert.Equal(t, 3, slots.free(0))
+	assert.Equal(t, 1, slots.free(2))
+
+	release1, err := slots.acquire(context.TODO())
+	assert.NoError(t, err)
+	release2, err := slots.acquire(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, slots.free(0))
+	// the queued tasks beyond the capacity don't make the free slots negative
+	assert.Equal(t, 0, slots.free(2))
+
+	// the blocked acquirers are counted until they get a slot or give up
+	release3, err := slots.acquire(context.TODO())
+	assert.NoError(t, err)
+	waiting := func() int {
+		slots.mu.Lock()
+		defer slots.mu.Unlock()
+		return slots.waiting
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := slots.acquire(ctx)
+		cancelled <- err
+	}()
+	acquired := make(chan func(), 1)
+	go func() {
+		release, err := slots.acquire(context.TODO())
+		assert.NoError(t, err)
+		acquired <- release
+	}()
+	assert.Eventually(t, func() bool { return waiting() == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, slots.free(0))
+	cancel()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+	assert.Equal(t, 1, waiting())
+
+	release3()
+	release4 := <-acquired
+	assert.Equal(t, 0, waiting())
+	assert.Equal(t, 0, slots.free(0))
+	release1()
+	release2()
+	release4()
+	assert.Equal(t, 3, slots.free(0))
+}
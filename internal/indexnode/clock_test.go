@@ -0,0 +1,187 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/pkg/util/paramtable"
+)
+
+// fakeClock is a clock which only moves forward by Advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) clockTicker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{c: make(chan time.Time, 1), interval: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, and fires the tickers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped.Load() || t.next.After(c.now) {
+			continue
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.interval)
+		}
+		// drop the tick if the previous one is not consumed, like time.Ticker
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+func (c *fakeClock) numTickers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tickers)
+}
+
+type fakeTicker struct {
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	stopped  atomic.Bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.stopped.Store(true)
+}
+
+func TestIndexNode_fakeClock(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	start := clock.Now()
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	clock.Advance(time.Minute)
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+	clock.Advance(2 * time.Minute)
+	elapsed, ok := in.indexTaskElapsed("cluster-1", 1)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Minute, elapsed)
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	clock.Advance(time.Hour)
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Equal(t, start, snapshots[0].CreateTime)
+	assert.Equal(t, start.Add(time.Minute), snapshots[0].StartTime)
+	assert.Equal(t, start.Add(3*time.Minute), snapshots[0].EndTime)
+	elapsed, _ = in.indexTaskElapsed("cluster-1", 1)
+	assert.Equal(t, 3*time.Minute, elapsed)
+}
+
+func TestIndexNode_waitTaskFinishFakeClock(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.GracefulStopTimeout.Key, "10")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.GracefulStopTimeout.Key)
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	drained := make(chan int)
+	go func() {
+		drained <- in.waitTaskFinish()
+	}()
+	assert.Eventually(t, func() bool { return clock.numTickers() == 1 }, time.Second, time.Millisecond)
+
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	clock.Advance(time.Second)
+	select {
+	case <-drained:
+		t.Fatal("waitTaskFinish returns with a task in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the graceful stop timeout is reached
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, 1, <-drained)
+}
+
+func TestIndexNode_gracefulStopProgress(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.GracefulStopTimeout.Key, "10")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.GracefulStopTimeout.Key)
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	_, _, draining := in.gracefulStopProgress()
+	assert.False(t, draining)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	drained := make(chan int)
+	go func() {
+		drained <- in.waitTaskFinish()
+	}()
+	assert.Eventually(t, func() bool { return clock.numTickers() == 1 }, time.Second, time.Millisecond)
+
+	elapsed, remaining, draining := in.gracefulStopProgress()
+	assert.True(t, draining)
+	assert.Equal(t, time.Duration(0), elapsed)
+	assert.Equal(t, 10*time.Second, remaining)
+	clock.Advance(3 * time.Second)
+	elapsed, remaining, draining = in.gracefulStopProgress()
+	assert.True(t, draining)
+	assert.Equal(t, 3*time.Second, elapsed)
+	assert.Equal(t, 7*time.Second, remaining)
+
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, <-drained)
+	_, _, draining = in.gracefulStopProgress()
+	assert.False(t, draining)
+}
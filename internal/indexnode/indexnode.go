@@ -108,6 +108,47 @@ type IndexNode struct {
 	initOnce  sync.Once
 	stateLock sync.Mutex
 	tasks     map[taskKey]*taskInfo
+	// buildID -> clusterID of the tasks, the last registered cluster wins on conflicts
+	buildClusters map[UniqueID]string
+	// total serialized size of the tracked index files per cluster
+	clusterSerializedSizes map[string]uint64
+	// rate limiters of the task state change logs per cluster
+	stateLogLimiters map[string]*stateLogLimiter
+	// recently deleted tasks
+	tombstones *taskTombstones
+	// the most recently finished task per cluster, repopulated by a scan when it's deleted
+	latestFinished map[string]taskKey
+	// the failed tasks retained per cluster, in the order they failed
+	clusterFailedTasks map[string][]taskKey
+	// the recent failures of builds, to quarantine the ones failing the same way repeatedly
+	buildFailures map[UniqueID]*buildFailure
+	// the number of tasks reaching a terminal state per cluster, and how many of them were cancelled
+	terminalTaskCounts map[string]*terminalTaskCount
+	// the recent outcomes of the tasks per cluster, in the order they reached a terminal state
+	recentOutcomes map[string]*taskOutcomes
+	// segmentID -> the task covering the segment, the task registered last wins on overlaps
+	segmentTasks map[int64]taskKey
+	// the deleted tasks whose cleanup is not done yet
+	deletingTasks map[taskKey]*taskInfo
+	// the recent registrations of the tasks
+	recentRegistrations taskRegistrations
+	// the recent decisions of admitting the tasks
+	admissionDecisions admissionDecisions
+	// the number of tasks per cluster, the clusters without task are absent
+	clusterTaskCounts map[string]int
+	// the last failure of the tasks per cluster
+	lastClusterErrors map[string]ClusterError
+	// the clusters being drained, which don't accept new tasks
+	drainingClusters map[string]struct{}
+	// the start and the budget of the graceful stop waiting for the in-progress tasks, zero if not waiting
+	gracefulStopStart   time.Time
+	gracefulStopTimeout time.Duration
+	// generation is increased on every registration and state change of the tasks
+	generation uint64
+	// clock is the time source of the task bookkeeping
+	clock clock
+
+	shutdownReport ShutdownReport
 }
 
 // NewIndexNode creates a new IndexNode component.
@@ -116,12 +157,27 @@ func NewIndexNode(ctx context.Context, factory dependency.Factory) *IndexNode {
 	rand.Seed(time.Now().UnixNano())
 	ctx1, cancel := context.WithCancel(ctx)
 	b := &IndexNode{
-		loopCtx:        ctx1,
-		loopCancel:     cancel,
-		factory:        factory,
-		storageFactory: NewChunkMgrFactory(),
-		tasks:          map[taskKey]*taskInfo{},
-		lifetime:       lifetime.NewLifetime(commonpb.StateCode_Abnormal),
+		loopCtx:                ctx1,
+		loopCancel:             cancel,
+		factory:                factory,
+		storageFactory:         NewChunkMgrFactory(),
+		tasks:                  map[taskKey]*taskInfo{},
+		buildClusters:          map[UniqueID]string{},
+		clusterSerializedSizes: map[string]uint64{},
+		stateLogLimiters:       map[string]*stateLogLimiter{},
+		tombstones:             newTaskTombstones(),
+		latestFinished:         map[string]taskKey{},
+		clusterFailedTasks:     map[string][]taskKey{},
+		buildFailures:          map[UniqueID]*buildFailure{},
+		terminalTaskCounts:     map[string]*terminalTaskCount{},
+		recentOutcomes:         map[string]*taskOutcomes{},
+		segmentTasks:           map[int64]taskKey{},
+		deletingTasks:          map[taskKey]*taskInfo{},
+		clusterTaskCounts:      map[string]int{},
+		lastClusterErrors:      map[string]ClusterError{},
+		drainingClusters:       map[string]struct{}{},
+		clock:                  realClock{},
+		lifetime:               lifetime.NewLifetime(commonpb.StateCode_Abnormal),
 	}
 	sc := NewTaskScheduler(b.loopCtx)
 
@@ -225,6 +281,7 @@ func (i *IndexNode) Start() error {
 	var startErr error
 	i.once.Do(func() {
 		startErr = i.sched.Start()
+		go i.statusLogLoop()
 
 		i.UpdateStateCode(commonpb.StateCode_Healthy)
 		log.Info("IndexNode", zap.String("State", i.lifetime.GetState().String()))
@@ -239,11 +296,12 @@ func (i *IndexNode) Stop() error {
 	i.stopOnce.Do(func() {
 		i.UpdateStateCode(commonpb.StateCode_Stopping)
 		log.Info("Index node stopping")
+		waited, drained := false, 0
 		err := i.session.GoingStop()
 		if err != nil {
 			log.Warn("session fail to go stopping state", zap.Error(err))
 		} else {
-			i.waitTaskFinish()
+			waited, drained = true, i.waitTaskFinish()
 		}
 
 		// https://github.com/milvus-io/milvus/issues/12282
@@ -251,12 +309,7 @@ func (i *IndexNode) Stop() error {
 		i.lifetime.Wait()
 		log.Info("Index node abnormal")
 		// cleanup all running tasks
-		deletedTasks := i.deleteAllTasks()
-		for _, task := range deletedTasks {
-			if task.cancel != nil {
-				task.cancel()
-			}
-		}
+		i.cleanupAllTasks(i.loopCtx, waited, drained)
 		if i.sched != nil {
 			i.sched.Close()
 		}
@@ -297,7 +350,7 @@ func (i *IndexNode) GetComponentStates(ctx context.Context, req *milvuspb.GetCom
 
 	ret := &milvuspb.ComponentStates{
 		State:              stateInfo,
-		SubcomponentStates: nil, // todo add subcomponents states
+		SubcomponentStates: []*milvuspb.ComponentInfo{i.taskReadinessState(nodeID)},
 		Status:             merr.Success(),
 	}
 
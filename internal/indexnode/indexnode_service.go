@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"strconv"
 
-	"github.com/golang/protobuf/proto"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -30,7 +29,6 @@ import (
 	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
 	"github.com/milvus-io/milvus-proto/go-api/v2/milvuspb"
 	"github.com/milvus-io/milvus/internal/proto/indexpb"
-	"github.com/milvus-io/milvus/pkg/common"
 	"github.com/milvus-io/milvus/pkg/log"
 	"github.com/milvus-io/milvus/pkg/metrics"
 	"github.com/milvus-io/milvus/pkg/util/merr"
@@ -77,10 +75,21 @@ func (i *IndexNode) CreateJob(ctx context.Context, req *indexpb.CreateJobRequest
 	metrics.IndexNodeBuildIndexTaskCounter.WithLabelValues(strconv.FormatInt(paramtable.GetNodeID(), 10), metrics.TotalLabel).Inc()
 
 	taskCtx, taskCancel := context.WithCancel(i.loopCtx)
-	if oldInfo := i.loadOrStoreTask(req.GetClusterID(), req.GetBuildID(), &taskInfo{
-		cancel: taskCancel,
-		state:  commonpb.IndexState_InProgress,
-	}); oldInfo != nil {
+	oldInfo, err := i.loadOrStoreTask(req.GetClusterID(), req.GetBuildID(), &taskInfo{
+		cancel:              taskCancel,
+		state:               commonpb.IndexState_Unissued,
+		currentIndexVersion: getCurrentIndexVersion(req.GetCurrentIndexVersion()),
+		segmentIDs:          []int64{req.GetSegmentID()},
+		indexVersion:        req.GetIndexVersion(),
+		isRebuild:           i.isRebuildAssignment(taskKey{ClusterID: req.GetClusterID(), BuildID: req.GetBuildID()}, req.GetIndexVersion()),
+	})
+	if err != nil {
+		taskCancel()
+		log.Warn("failed to register index build task", zap.Error(err))
+		metrics.IndexNodeBuildIndexTaskCounter.WithLabelValues(fmt.Sprint(paramtable.GetNodeID()), metrics.FailLabel).Inc()
+		return merr.Status(err), nil
+	}
+	if oldInfo != nil {
 		err := merr.WrapErrIndexDuplicate(req.GetIndexName(), "building index task existed")
 		log.Warn("duplicated index build task", zap.Error(err))
 		metrics.IndexNodeBuildIndexTaskCounter.WithLabelValues(fmt.Sprint(paramtable.GetNodeID()), metrics.FailLabel).Inc()
@@ -92,7 +101,7 @@ func (i *IndexNode) CreateJob(ctx context.Context, req *indexpb.CreateJobRequest
 			zap.String("accessKey", req.GetStorageConfig().GetAccessKeyID()),
 			zap.Error(err),
 		)
-		i.deleteTaskInfos(ctx, []taskKey{{ClusterID: req.GetClusterID(), BuildID: req.GetBuildID()}})
+		i.cleanupDeletedTasks(ctx, i.deleteTaskInfos(ctx, []taskKey{{ClusterID: req.GetClusterID(), BuildID: req.GetBuildID()}}))
 		metrics.IndexNodeBuildIndexTaskCounter.WithLabelValues(fmt.Sprint(paramtable.GetNodeID()), metrics.FailLabel).Inc()
 		return merr.Status(err), nil
 	}
@@ -158,12 +167,17 @@ func (i *IndexNode) QueryJobs(ctx context.Context, req *indexpb.QueryJobsRequest
 		if ClusterID == req.GetClusterID() {
 			infos[buildID] = &taskInfo{
 				state:               info.state,
-				fileKeys:            common.CloneStringList(info.fileKeys),
+				fileKeys:            info.fileKeys,
 				serializedSize:      info.serializedSize,
 				failReason:          info.failReason,
 				currentIndexVersion: info.currentIndexVersion,
 				indexStoreVersion:   info.indexStoreVersion,
 			}
+			// the placeholder is reassigned by the coordinator instead of being waited for
+			if isReconciledPlaceholder(info) {
+				infos[buildID].state = commonpb.IndexState_Retry
+				infos[buildID].failReason = placeholderRetryReason
+			}
 		}
 	})
 	ret := &indexpb.QueryJobsResponse{
@@ -180,7 +194,7 @@ func (i *IndexNode) QueryJobs(ctx context.Context, req *indexpb.QueryJobsRequest
 		})
 		if info, ok := infos[buildID]; ok {
 			ret.IndexInfos[i].State = info.state
-			ret.IndexInfos[i].IndexFileKeys = info.fileKeys
+			ret.IndexInfos[i].IndexFileKeys = info.fileKeys.keys()
 			ret.IndexInfos[i].SerializedSize = info.serializedSize
 			ret.IndexInfos[i].FailReason = info.failReason
 			ret.IndexInfos[i].CurrentIndexVersion = info.currentIndexVersion
@@ -210,11 +224,7 @@ func (i *IndexNode) DropJobs(ctx context.Context, req *indexpb.DropJobsRequest)
 		keys = append(keys, taskKey{ClusterID: req.GetClusterID(), BuildID: buildID})
 	}
 	infos := i.deleteTaskInfos(ctx, keys)
-	for _, info := range infos {
-		if info.cancel != nil {
-			info.cancel()
-		}
-	}
+	i.cleanupDeletedTasks(ctx, infos)
 	log.Ctx(ctx).Info("drop index build jobs success", zap.String("clusterID", req.GetClusterID()),
 		zap.Int64s("indexBuildIDs", req.GetBuildIDs()))
 	return merr.Success(), nil
@@ -231,14 +241,12 @@ func (i *IndexNode) GetJobStats(ctx context.Context, req *indexpb.GetJobStatsReq
 	unissued, active := i.sched.IndexBuildQueue.GetTaskNum()
 	jobInfos := make([]*indexpb.JobInfo, 0)
 	i.foreachTaskInfo(func(ClusterID string, buildID UniqueID, info *taskInfo) {
-		if info.statistic != nil {
-			jobInfos = append(jobInfos, proto.Clone(info.statistic).(*indexpb.JobInfo))
+		if statistic, _ := cloneStatistic(taskKey{ClusterID: ClusterID, BuildID: buildID}, info.statistic); statistic != nil {
+			jobInfos = append(jobInfos, statistic)
 		}
 	})
-	slots := 0
-	if i.sched.buildParallel > unissued+active {
-		slots = i.sched.buildParallel - unissued - active
-	}
+	// the slots reserved by ReserveBuildSlot and the tasks waiting for a slot are not free either
+	slots := i.sched.buildSlots.free(unissued)
 	log.Ctx(ctx).Info("Get Index Job Stats",
 		zap.Int("unissued", unissued),
 		zap.Int("active", active),
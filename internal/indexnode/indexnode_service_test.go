@@ -28,6 +28,7 @@ import (
 	"github.com/milvus-io/milvus/internal/proto/internalpb"
 	"github.com/milvus-io/milvus/pkg/util/merr"
 	"github.com/milvus-io/milvus/pkg/util/metricsinfo"
+	"github.com/milvus-io/milvus/pkg/util/paramtable"
 )
 
 func TestAbnormalIndexNode(t *testing.T) {
@@ -60,6 +61,50 @@ func TestAbnormalIndexNode(t *testing.T) {
 	assert.ErrorIs(t, err, merr.ErrServiceNotReady)
 }
 
+func TestQueryJobsAllFileKeys(t *testing.T) {
+	ctx := context.TODO()
+	in := newTestIndexNode()
+	in.UpdateStateCode(commonpb.StateCode_Healthy)
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxDumpedIndexFileKeys.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.MaxDumpedIndexFileKeys.Key)
+
+	fileKeys := []string{"files/1/a", "files/1/b", "files/1/c"}
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	err := in.finishIndexTask(ctx, "cluster-1", 1, IndexResult{FileKeys: fileKeys, SerializedSize: 100})
+	assert.NoError(t, err)
+
+	// the coordinator gets all the keys, while the dumps only carry a sample of them
+	resp, err := in.QueryJobs(ctx, &indexpb.QueryJobsRequest{ClusterID: "cluster-1", BuildIDs: []int64{1}})
+	assert.NoError(t, err)
+	assert.True(t, merr.Ok(resp.GetStatus()))
+	assert.Len(t, resp.GetIndexInfos(), 1)
+	assert.Equal(t, commonpb.IndexState_Finished, resp.GetIndexInfos()[0].GetState())
+	assert.Equal(t, fileKeys, resp.GetIndexInfos()[0].GetIndexFileKeys())
+	assert.Equal(t, fileKeys[:2], in.indexTaskSnapshots()[0].FileKeys)
+}
+
+func TestQueryJobsReconciledPlaceholder(t *testing.T) {
+	ctx := context.TODO()
+	in := newTestIndexNode()
+	in.UpdateStateCode(commonpb.StateCode_Healthy)
+	in.reconcileFromCoordinator(ctx, []*indexpb.IndexTaskMeta{
+		{ClusterID: "cluster-1", BuildID: 1},
+		{ClusterID: "cluster-1", BuildID: 2},
+	})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Unissued})
+
+	// the placeholder not created again is reported as Retry, so that the coordinator reassigns it
+	resp, err := in.QueryJobs(ctx, &indexpb.QueryJobsRequest{ClusterID: "cluster-1", BuildIDs: []int64{1, 2}})
+	assert.NoError(t, err)
+	assert.True(t, merr.Ok(resp.GetStatus()))
+	assert.Len(t, resp.GetIndexInfos(), 2)
+	assert.Equal(t, commonpb.IndexState_Retry, resp.GetIndexInfos()[0].GetState())
+	assert.Equal(t, placeholderRetryReason, resp.GetIndexInfos()[0].GetFailReason())
+	assert.Equal(t, commonpb.IndexState_Unissued, resp.GetIndexInfos()[1].GetState())
+	// the placeholder is still tracked as Unissued locally
+	assert.Equal(t, commonpb.IndexState_Unissued, in.loadTaskState("cluster-1", 1))
+}
+
 func TestGetMetrics(t *testing.T) {
 	var (
 		ctx          = context.TODO()
@@ -54,13 +54,57 @@ var (
 type Blob = storage.Blob
 
 type taskInfo struct {
-	cancel              context.CancelFunc
+	// key is set when the task is stored, so that the task is identified after it's deleted
+	key    taskKey
+	cancel context.CancelFunc
+	// onDelete is an optional hook to release the resources of the task after it's deleted
+	onDelete            func() error
 	state               commonpb.IndexState
-	fileKeys            []string
+	fileKeys            indexFileKeys
 	serializedSize      uint64
 	failReason          string
 	currentIndexVersion int32
 	indexStoreVersion   int64
+	// versionFileKeys retains the file keys of the index versions other than currentIndexVersion
+	versionFileKeys map[int32]indexFileKeys
+	// createTime is when the task is registered, startTime is when it starts to run,
+	// endTime is when it reaches a terminal state
+	createTime time.Time
+	startTime  time.Time
+	endTime    time.Time
+	// whether the state has been updated since the task is registered
+	stateUpdated bool
+	// workerID is the scheduler worker running the task
+	workerID string
+	// indexVersion is the version of the assignment of the build by the coordinator
+	indexVersion int64
+	// isRebuild is set if the build was finished by this node before it's assigned again, see isRebuildAssignment
+	isRebuild bool
+	// segmentIDs are the segments covered by the build
+	segmentIDs []int64
+	// actualMem is the resident memory of the native build reported last
+	actualMem uint64
+	// version is increased on every mutation of the task, to detect conflicting concurrent writes
+	version uint64
+	// generation is the generation of the index node when the task is registered or its state changes last
+	generation uint64
+	// stateChangedAt is when the task is registered or its state changes last
+	stateChangedAt time.Time
+	// cancelled is set when the task is cancelled on purpose, the cause is kept in cancelReason
+	// instead of failReason, so that cancellations are not taken as build failures
+	cancelled    bool
+	cancelReason string
+	// uncancellable is set while the task is in a critical section, in which it's not cancelled by any path
+	uncancellable bool
+	// reconciled is set for the placeholder of a task known by the coordinator after restart,
+	// the placeholder is replaced when the job is created again
+	reconciled bool
+	// diagnostics is attached by failIndexTask to help troubleshooting the failure
+	diagnostics map[string]string
+	// cleanedUp is created when the task is deleted, and closed once its cleanup is done
+	cleanedUp chan struct{}
+	// terminated is created by the waiters of the task, and closed once it reaches a terminal state or is deleted
+	terminated chan struct{}
 
 	// task statistics
 	statistic *indexpb.JobInfo
@@ -76,6 +120,9 @@ type task interface {
 	OnEnqueue(context.Context) error
 	SetState(state commonpb.IndexState, failReason string)
 	GetState() commonpb.IndexState
+	// Dequeue moves the queued task to InProgress, it returns false if the task is not queued anymore
+	Dequeue() bool
+	SetWorker(workerID string)
 	Reset()
 }
 
@@ -234,7 +281,16 @@ func (it *indexBuildTaskV2) SaveIndexFiles(ctx context.Context) error {
 	saveFileKeys := make([]string, 0)
 
 	it.statistic.EndTime = time.Now().UnixMicro()
-	it.node.storeIndexFilesAndStatisticV2(it.ClusterID, it.BuildID, saveFileKeys, it.serializedSize, &it.statistic, it.currentIndexVersion, version)
+	if err := it.node.finishIndexTask(ctx, it.ClusterID, it.BuildID, IndexResult{
+		FileKeys:            saveFileKeys,
+		SerializedSize:      it.serializedSize,
+		Statistic:           &it.statistic,
+		CurrentIndexVersion: it.currentIndexVersion,
+		IndexStoreVersion:   version,
+	}); err != nil {
+		log.Ctx(ctx).Warn("failed to store index files", zap.Error(err))
+		return err
+	}
 	log.Ctx(ctx).Debug("save index files done", zap.Strings("IndexFiles", saveFileKeys))
 	saveIndexFileDur := it.tr.RecordSpan()
 	metrics.IndexNodeSaveIndexFileLatency.WithLabelValues(strconv.FormatInt(paramtable.GetNodeID(), 10)).Observe(saveIndexFileDur.Seconds())
@@ -302,7 +358,15 @@ func (it *indexBuildTask) Name() string {
 }
 
 func (it *indexBuildTask) SetState(state commonpb.IndexState, failReason string) {
-	it.node.storeTaskState(it.ClusterID, it.BuildID, state, failReason)
+	it.node.storeTaskState(it.ctx, it.ClusterID, it.BuildID, state, failReason)
+}
+
+func (it *indexBuildTask) Dequeue() bool {
+	return len(it.node.dequeueForExecution(it.ctx, []taskKey{{ClusterID: it.ClusterID, BuildID: it.BuildID}})) > 0
+}
+
+func (it *indexBuildTask) SetWorker(workerID string) {
+	it.node.storeTaskWorker(it.ClusterID, it.BuildID, workerID)
 }
 
 func (it *indexBuildTask) GetState() commonpb.IndexState {
@@ -591,7 +655,15 @@ func (it *indexBuildTask) SaveIndexFiles(ctx context.Context) error {
 	}
 
 	it.statistic.EndTime = time.Now().UnixMicro()
-	it.node.storeIndexFilesAndStatistic(it.ClusterID, it.BuildID, saveFileKeys, it.serializedSize, &it.statistic, it.currentIndexVersion)
+	if err := it.node.finishIndexTask(ctx, it.ClusterID, it.BuildID, IndexResult{
+		FileKeys:            saveFileKeys,
+		SerializedSize:      it.serializedSize,
+		Statistic:           &it.statistic,
+		CurrentIndexVersion: it.currentIndexVersion,
+	}); err != nil {
+		log.Ctx(ctx).Warn("failed to store index files", zap.Error(err))
+		return err
+	}
 	log.Ctx(ctx).Debug("save index files done", zap.Strings("IndexFiles", saveFileKeys))
 	saveIndexFileDur := it.tr.RecordSpan()
 	metrics.IndexNodeSaveIndexFileLatency.WithLabelValues(strconv.FormatInt(paramtable.GetNodeID(), 10)).Observe(saveIndexFileDur.Seconds())
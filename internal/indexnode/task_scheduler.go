@@ -170,19 +170,19 @@ func NewIndexBuildTaskQueue(sched *TaskScheduler) *IndexTaskQueue {
 type TaskScheduler struct {
 	IndexBuildQueue TaskQueue
 
-	buildParallel int
-	wg            sync.WaitGroup
-	ctx           context.Context
-	cancel        context.CancelFunc
+	buildSlots *buildSlots
+	wg         sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
 // NewTaskScheduler creates a new task scheduler of indexing tasks.
 func NewTaskScheduler(ctx context.Context) *TaskScheduler {
 	ctx1, cancel := context.WithCancel(ctx)
 	s := &TaskScheduler{
-		ctx:           ctx1,
-		cancel:        cancel,
-		buildParallel: Params.IndexNodeCfg.BuildParallel.GetAsInt(),
+		ctx:        ctx1,
+		cancel:     cancel,
+		buildSlots: newBuildSlots(Params.IndexNodeCfg.BuildParallel.GetAsInt()),
 	}
 	s.IndexBuildQueue = NewIndexBuildTaskQueue(s)
 
@@ -191,7 +191,8 @@ func NewTaskScheduler(ctx context.Context) *TaskScheduler {
 
 func (sched *TaskScheduler) scheduleIndexBuildTask() []task {
 	ret := make([]task, 0)
-	for i := 0; i < sched.buildParallel; i++ {
+	buildParallel := sched.buildSlots.getCapacity()
+	for i := 0; i < buildParallel; i++ {
 		t := sched.IndexBuildQueue.PopUnissuedTask()
 		if t == nil {
 			return ret
@@ -207,11 +208,15 @@ func getStateFromError(err error) commonpb.IndexState {
 	} else if errors.Is(err, merr.ErrIoKeyNotFound) || errors.Is(err, merr.ErrSegcoreUnsupported) {
 		// NoSuchKey or unsupported error
 		return commonpb.IndexState_Failed
+	} else if errors.Is(err, merr.ErrServiceQuotaExceeded) {
+		// retry won't help, the index of the task is too large, or the tracked index files of the cluster
+		// have to be dropped first
+		return commonpb.IndexState_Failed
 	}
 	return commonpb.IndexState_Retry
 }
 
-func (sched *TaskScheduler) processTask(t task, q TaskQueue) {
+func (sched *TaskScheduler) processTask(t task, q TaskQueue, workerID string) {
 	wrap := func(fn func(ctx context.Context) error) error {
 		select {
 		case <-t.Ctx().Done():
@@ -227,7 +232,9 @@ func (sched *TaskScheduler) processTask(t task, q TaskQueue) {
 	}()
 	sched.IndexBuildQueue.AddActiveTask(t)
 	defer sched.IndexBuildQueue.PopActiveTask(t.Name())
+	t.SetWorker(workerID)
 	log.Ctx(t.Ctx()).Debug("process task", zap.String("task", t.Name()))
+	// the task is finished by SaveIndexFiles along with storing its index files
 	pipelines := []func(context.Context) error{t.Prepare, t.BuildIndex, t.SaveIndexFiles}
 	for _, fn := range pipelines {
 		if err := wrap(fn); err != nil {
@@ -236,7 +243,6 @@ func (sched *TaskScheduler) processTask(t task, q TaskQueue) {
 			return
 		}
 	}
-	t.SetState(commonpb.IndexState_Finished, "")
 	if indexBuildTask, ok := t.(*indexBuildTask); ok {
 		metrics.IndexNodeBuildIndexLatency.WithLabelValues(fmt.Sprint(paramtable.GetNodeID())).Observe(indexBuildTask.tr.ElapseSpan().Seconds())
 		metrics.IndexNodeIndexTaskLatencyInQueue.WithLabelValues(fmt.Sprint(paramtable.GetNodeID())).Observe(float64(indexBuildTask.queueDur.Milliseconds()))
@@ -253,12 +259,26 @@ func (sched *TaskScheduler) indexBuildLoop() {
 		case <-sched.IndexBuildQueue.utChan():
 			tasks := sched.scheduleIndexBuildTask()
 			var wg sync.WaitGroup
-			for _, t := range tasks {
+			for idx, t := range tasks {
 				wg.Add(1)
-				go func(group *sync.WaitGroup, t task) {
+				go func(group *sync.WaitGroup, t task, workerID string) {
 					defer group.Done()
-					sched.processTask(t, sched.IndexBuildQueue)
-				}(&wg, t)
+					// the slots reserved by ReserveBuildSlot hold the task back
+					release, err := sched.buildSlots.acquire(sched.ctx)
+					if err != nil {
+						log.Ctx(t.Ctx()).Warn("failed to acquire build slot", zap.String("task", t.Name()), zap.Error(err))
+						t.SetState(commonpb.IndexState_Retry, err.Error())
+						return
+					}
+					defer release()
+					// the task is queued until it's picked up here, the one cancelled or failed meanwhile is not run
+					if !t.Dequeue() {
+						log.Ctx(t.Ctx()).Info("skip task which is not queued anymore", zap.String("task", t.Name()))
+						t.Reset()
+						return
+					}
+					sched.processTask(t, sched.IndexBuildQueue, workerID)
+				}(&wg, t, fmt.Sprintf("index-build-worker-%d", idx))
 			}
 			wg.Wait()
 		}
@@ -75,6 +75,9 @@ type fakeTask struct {
 	retstate      commonpb.IndexState
 	expectedState commonpb.IndexState
 	failReason    string
+	workerID      string
+	// notQueued makes Dequeue fail, as if the task was cancelled while queued
+	notQueued bool
 }
 
 var _ task = &fakeTask{}
@@ -115,7 +118,11 @@ func (t *fakeTask) BuildIndex(ctx context.Context) error {
 func (t *fakeTask) SaveIndexFiles(ctx context.Context) error {
 	t.state = fakeTaskSavedIndexes
 	t.ctx.(*stagectx).setState(t.state)
-	return t.reterr[t.state]
+	if err := t.reterr[t.state]; err != nil {
+		return err
+	}
+	t.SetState(commonpb.IndexState_Finished, "")
+	return nil
 }
 
 func (t *fakeTask) Reset() {
@@ -127,6 +134,18 @@ func (t *fakeTask) SetState(state commonpb.IndexState, failReason string) {
 	t.failReason = failReason
 }
 
+func (t *fakeTask) Dequeue() bool {
+	if t.notQueued {
+		return false
+	}
+	t.retstate = commonpb.IndexState_InProgress
+	return true
+}
+
+func (t *fakeTask) SetWorker(workerID string) {
+	t.workerID = workerID
+}
+
 func (t *fakeTask) GetState() commonpb.IndexState {
 	return t.retstate
 }
@@ -180,6 +199,7 @@ func TestIndexTaskScheduler(t *testing.T) {
 
 	for _, task := range tasks[:len(tasks)-1] {
 		assert.Equal(t, task.GetState(), task.(*fakeTask).expectedState)
+		assert.Contains(t, task.(*fakeTask).workerID, "index-build-worker-")
 		assert.Equal(t, task.Ctx().(*stagectx).curstate, task.Ctx().(*stagectx).state2cancel)
 	}
 
@@ -205,3 +225,25 @@ func TestIndexTaskScheduler(t *testing.T) {
 		assert.Equal(t, task.GetState(), commonpb.IndexState_Finished)
 	}
 }
+
+func TestIndexTaskScheduler_skipNotQueued(t *testing.T) {
+	paramtable.Init()
+
+	scheduler := NewTaskScheduler(context.TODO())
+	scheduler.Start()
+
+	skipped := newTask(fakeTaskSavedIndexes, nil, commonpb.IndexState_IndexStateNone)
+	skipped.(*fakeTask).notQueued = true
+	processed := newTask(fakeTaskSavedIndexes, nil, commonpb.IndexState_Finished)
+	assert.Nil(t, scheduler.IndexBuildQueue.Enqueue(skipped))
+	assert.Nil(t, scheduler.IndexBuildQueue.Enqueue(processed))
+	_taskwg.Wait()
+	scheduler.Close()
+	scheduler.wg.Wait()
+
+	// the task not queued anymore is neither run nor moved to InProgress
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, skipped.GetState())
+	assert.Equal(t, fakeTaskState(fakeTaskEnqueued), skipped.Ctx().(*stagectx).curstate)
+	assert.Empty(t, skipped.(*fakeTask).workerID)
+	assert.Equal(t, commonpb.IndexState_Finished, processed.GetState())
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/apache/arrow/go/v12/arrow"
 	"github.com/apache/arrow/go/v12/arrow/array"
 	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 
 	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
@@ -322,3 +323,26 @@ func (suite *IndexBuildTaskV2Suite) TestBuildIndex() {
 func TestIndexBuildTaskV2Suite(t *testing.T) {
 	suite.Run(t, new(IndexBuildTaskV2Suite))
 }
+
+func TestIndexBuildTask_SetStateAfterFailAllInProgress(t *testing.T) {
+	in := newTestIndexNode()
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	assert.NoError(t, err)
+	it := &indexBuildTask{ident: "test", ctx: ctx, ClusterID: "cluster-1", BuildID: 1, node: in}
+
+	assert.Equal(t, 1, in.failAllInProgress("storage unreachable"))
+	// the cancelled build reports retry, which doesn't override the failure
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	it.SetState(getStateFromError(errCancel), errCancel.Error())
+	snapshots := in.indexTaskSnapshots()
+	assert.Equal(t, commonpb.IndexState_Failed, snapshots[0].State)
+	assert.Equal(t, "storage unreachable", snapshots[0].FailReason)
+	assert.Equal(t, 1, in.retainedFailedTasks("cluster-1"))
+
+	// the late result of the build is dropped as well
+	err = in.finishIndexTask(ctx, "cluster-1", 1, IndexResult{FileKeys: []string{"file"}, SerializedSize: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, commonpb.IndexState_Failed, in.loadTaskState("cluster-1", 1))
+	assert.Equal(t, uint64(0), in.clusterSerializedSize("cluster-1"))
+}
@@ -0,0 +1,92 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"time"
+)
+
+// maxAdmissionDecisions bounds the recent admission decisions kept.
+const maxAdmissionDecisions = 1024
+
+// AdmissionOutcome is the outcome of admitting a task.
+type AdmissionOutcome string
+
+const (
+	admissionAdmitted             AdmissionOutcome = "admitted"
+	admissionRejectedInvalid      AdmissionOutcome = "rejected-invalid"
+	admissionRejectedDuplicate    AdmissionOutcome = "rejected-duplicate"
+	admissionRejectedDraining     AdmissionOutcome = "rejected-draining"
+	admissionRejectedQuarantine   AdmissionOutcome = "rejected-quarantine"
+	admissionRejectedBusy         AdmissionOutcome = "rejected-busy"
+	admissionRejectedClusterLimit AdmissionOutcome = "rejected-cluster-limit"
+)
+
+// AdmissionDecision records why a task is admitted or rejected.
+type AdmissionDecision struct {
+	ClusterID string
+	BuildID   UniqueID
+	Outcome   AdmissionOutcome
+	Reason    string
+	Time      time.Time
+}
+
+// admissionDecisions is a ring of the recent decisions, the oldest one is overwritten once it's full.
+type admissionDecisions struct {
+	decisions []AdmissionDecision
+	next      int
+}
+
+func (d *admissionDecisions) add(decision AdmissionDecision) {
+	if len(d.decisions) < maxAdmissionDecisions {
+		d.decisions = append(d.decisions, decision)
+		return
+	}
+	d.decisions[d.next] = decision
+	d.next = (d.next + 1) % maxAdmissionDecisions
+}
+
+// recordAdmission records the admission decision of the task, stateLock must be held by the caller.
+func (i *IndexNode) recordAdmission(key taskKey, outcome AdmissionOutcome, reason string) {
+	i.admissionDecisions.add(AdmissionDecision{
+		ClusterID: key.ClusterID,
+		BuildID:   key.BuildID,
+		Outcome:   outcome,
+		Reason:    reason,
+		Time:      i.clock.Now(),
+	})
+}
+
+// recentAdmissionDecisions returns the latest n admission decisions, the latest first.
+func (i *IndexNode) recentAdmissionDecisions(n int) []AdmissionDecision {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	decisions := i.admissionDecisions.decisions
+	if n > len(decisions) {
+		n = len(decisions)
+	}
+	if n <= 0 {
+		return []AdmissionDecision{}
+	}
+	recent := make([]AdmissionDecision, 0, n)
+	// the latest decision is right before next, next stays 0 until the ring is full
+	latest := i.admissionDecisions.next - 1 + len(decisions)
+	for idx := 0; idx < n; idx++ {
+		recent = append(recent, decisions[(latest-idx+len(decisions))%len(decisions)])
+	}
+	return recent
+}
@@ -0,0 +1,63 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"strconv"
+
+	"github.com/milvus-io/milvus/pkg/metrics"
+	"github.com/milvus-io/milvus/pkg/util/paramtable"
+)
+
+type terminalTaskCount struct {
+	cancelled int64
+	total     int64
+}
+
+func (c *terminalTaskCount) cancelledRatio() float64 {
+	if c.total == 0 {
+		return 0
+	}
+	return float64(c.cancelled) / float64(c.total)
+}
+
+// countTerminalTask counts the task reaching a terminal state, and updates the cancelled ratio of its cluster.
+// stateLock must be held by the caller.
+func (i *IndexNode) countTerminalTask(key taskKey, cancelled bool) {
+	count, ok := i.terminalTaskCounts[key.ClusterID]
+	if !ok {
+		count = &terminalTaskCount{}
+		i.terminalTaskCounts[key.ClusterID] = count
+	}
+	count.total++
+	if cancelled {
+		count.cancelled++
+	}
+	metrics.IndexNodeCancelledTaskRatio.WithLabelValues(strconv.FormatInt(paramtable.GetNodeID(), 10), key.ClusterID).
+		Set(count.cancelledRatio())
+}
+
+// cancelledTaskRatio returns the ratio of cancelled tasks to the tasks of the cluster reaching a terminal state.
+func (i *IndexNode) cancelledTaskRatio(clusterID string) float64 {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	count, ok := i.terminalTaskCounts[clusterID]
+	if !ok {
+		return 0
+	}
+	return count.cancelledRatio()
+}
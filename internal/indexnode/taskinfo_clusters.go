@@ -0,0 +1,77 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"fmt"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/milvus-io/milvus/pkg/log"
+	"github.com/milvus-io/milvus/pkg/metrics"
+	"github.com/milvus-io/milvus/pkg/util/merr"
+	"github.com/milvus-io/milvus/pkg/util/paramtable"
+)
+
+// untrackClusterTask removes a deleted task from the task count of its cluster, and forgets the cluster
+// along with its last error, terminal task counts, recent outcomes, state log limiter and metrics once it has no task left,
+// so that the state kept per cluster doesn't grow as the clusters come and go. stateLock must be held by the caller.
+func (i *IndexNode) untrackClusterTask(key taskKey) {
+	i.clusterTaskCounts[key.ClusterID]--
+	if i.clusterTaskCounts[key.ClusterID] <= 0 {
+		delete(i.clusterTaskCounts, key.ClusterID)
+		delete(i.lastClusterErrors, key.ClusterID)
+		delete(i.terminalTaskCounts, key.ClusterID)
+		delete(i.recentOutcomes, key.ClusterID)
+		delete(i.stateLogLimiters, key.ClusterID)
+		deleteClusterMetrics(key.ClusterID)
+	}
+}
+
+// deleteClusterMetrics deletes the label values of the per cluster metrics of the cluster.
+func deleteClusterMetrics(clusterID string) {
+	nodeID := strconv.FormatInt(paramtable.GetNodeID(), 10)
+	metrics.IndexNodeTaskFirstUpdateLatency.DeleteLabelValues(nodeID, clusterID)
+	metrics.IndexNodeCancelledTaskRatio.DeleteLabelValues(nodeID, clusterID)
+	for _, name := range jobStatNames {
+		metrics.IndexNodeFinishedTaskStats.DeleteLabelValues(nodeID, clusterID, name)
+	}
+}
+
+// checkClusterLimit warns if the task of a new cluster makes the distinct clusters exceed MaxDistinctClusters,
+// and rejects it if RejectClustersOverLimit is set. stateLock must be held by the caller.
+func (i *IndexNode) checkClusterLimit(key taskKey) error {
+	limit := Params.IndexNodeCfg.MaxDistinctClusters.GetAsInt()
+	if limit <= 0 || i.clusterTaskCounts[key.ClusterID] > 0 || len(i.clusterTaskCounts) < limit {
+		return nil
+	}
+	log.Warn("IndexNode serve too many distinct clusters", zap.String("clusterID", key.ClusterID),
+		zap.Int64("buildID", key.BuildID), zap.Int("clusters", len(i.clusterTaskCounts)), zap.Int("limit", limit))
+	if !Params.IndexNodeCfg.RejectClustersOverLimit.GetAsBool() {
+		return nil
+	}
+	return merr.WrapErrServiceQuotaExceeded("too many distinct clusters",
+		fmt.Sprintf("clusterID=%s, buildID=%d, limit=%d", key.ClusterID, key.BuildID, limit))
+}
+
+// distinctClusterCount returns the number of the distinct clusters having tasks on the index node.
+func (i *IndexNode) distinctClusterCount() int {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	return len(i.clusterTaskCounts)
+}
@@ -0,0 +1,80 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.uber.org/zap"
+
+	"github.com/milvus-io/milvus/pkg/log"
+)
+
+var errTaskBusy = errors.New("index task is being cleaned up, retry later")
+
+// waitTaskCleanedUp waits for the cleanup of the deleted task with the key up to TaskDeletionWaitTimeout,
+// so that the task registered again doesn't use the resources of its predecessor being released.
+// It returns errTaskBusy if the cleanup is not done in time.
+func (i *IndexNode) waitTaskCleanedUp(key taskKey) error {
+	timeout := Params.IndexNodeCfg.TaskDeletionWaitTimeout.GetAsDuration(time.Millisecond)
+	if timeout <= 0 {
+		return nil
+	}
+	i.stateLock.Lock()
+	var cleanedUp chan struct{}
+	if info, ok := i.deletingTasks[key]; ok {
+		cleanedUp = info.cleanedUp
+	}
+	i.stateLock.Unlock()
+	if cleanedUp == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-cleanedUp:
+		return nil
+	case <-timer.C:
+		log.Warn("IndexNode timeout waiting for the cleanup of the deleted task", zap.String("clusterID", key.ClusterID),
+			zap.Int64("buildID", key.BuildID), zap.Duration("timeout", timeout))
+		return errors.Wrapf(errTaskBusy, "clusterID=%s, buildID=%d", key.ClusterID, key.BuildID)
+	}
+}
+
+// finishTaskCleanup wakes up the registrations waiting for the cleanup of the deleted tasks.
+func (i *IndexNode) finishTaskCleanup(infos []*taskInfo) {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	finished := make(map[*taskInfo]struct{}, len(infos))
+	for _, info := range infos {
+		if info.cleanedUp != nil {
+			close(info.cleanedUp)
+			info.cleanedUp = nil
+			finished[info] = struct{}{}
+		}
+	}
+	if len(finished) == 0 {
+		return
+	}
+	for key, info := range i.deletingTasks {
+		if _, ok := finished[info]; ok {
+			delete(i.deletingTasks, key)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"encoding/json"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/milvus-io/milvus/pkg/util/merr"
+)
+
+// IndexTaskDetail is the full detail of an index task for troubleshooting.
+type IndexTaskDetail struct {
+	IndexTaskSnapshot
+	// VersionFileKeys are the file keys retained for the index versions other than the current one
+	VersionFileKeys map[int32][]string
+	SegmentIDs      []int64
+	IsRebuild       bool
+	Uncancellable   bool
+	Version         uint64
+	Generation      uint64
+	StateUpdated    bool
+	Reconciled      bool
+}
+
+// DumpTaskDetail returns the full detail of the task as a JSON document, to be attached to support bundles.
+func (i *IndexNode) DumpTaskDetail(clusterID string, buildID UniqueID) ([]byte, error) {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	info, ok := i.tasks[key]
+	if !ok {
+		i.stateLock.Unlock()
+		return nil, merr.WrapErrParameterInvalidMsg("index task not found, clusterID=%s, buildID=%d", clusterID, buildID)
+	}
+	detail := IndexTaskDetail{
+		IndexTaskSnapshot: newIndexTaskSnapshot(key, info),
+		VersionFileKeys:   make(map[int32][]string, len(info.versionFileKeys)),
+		SegmentIDs:        slices.Clone(info.segmentIDs),
+		IsRebuild:         info.isRebuild,
+		Uncancellable:     info.uncancellable,
+		Version:           info.version,
+		Generation:        info.generation,
+		StateUpdated:      info.stateUpdated,
+		Reconciled:        info.reconciled,
+	}
+	limit := Params.IndexNodeCfg.MaxDumpedIndexFileKeys.GetAsInt()
+	for version, fileKeys := range info.versionFileKeys {
+		detail.VersionFileKeys[version] = fileKeys.sample(limit)
+	}
+	i.stateLock.Unlock()
+
+	return json.Marshal(detail)
+}
@@ -0,0 +1,88 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.uber.org/zap"
+
+	"github.com/milvus-io/milvus/pkg/log"
+)
+
+// drainCluster stops accepting new tasks of the cluster, waits for its queued and running tasks to be done,
+// and then deletes all the tasks of the cluster. The waiting is bounded by ctx and GracefulStopTimeout,
+// it returns an error with the tasks kept if they are not done in time.
+// The cluster accepts new tasks again once drainCluster returns.
+func (i *IndexNode) drainCluster(ctx context.Context, clusterID string) error {
+	i.stateLock.Lock()
+	i.drainingClusters[clusterID] = struct{}{}
+	i.stateLock.Unlock()
+	defer func() {
+		i.stateLock.Lock()
+		delete(i.drainingClusters, clusterID)
+		i.stateLock.Unlock()
+	}()
+
+	log := log.Ctx(ctx).With(zap.String("clusterID", clusterID))
+	ticker := i.clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := i.clock.Now().Add(Params.IndexNodeCfg.GracefulStopTimeout.GetAsDuration(time.Second))
+	for {
+		pending := i.numPendingTasksOfCluster(clusterID)
+		if pending == 0 {
+			break
+		}
+		if !i.clock.Now().Before(deadline) {
+			log.Warn("IndexNode drain cluster timeout", zap.Int("pending", pending))
+			return errors.Newf("drain cluster %s timeout, %d tasks are not done", clusterID, pending)
+		}
+		select {
+		case <-ctx.Done():
+			log.Warn("IndexNode drain cluster cancelled", zap.Int("pending", pending), zap.Error(ctx.Err()))
+			return errors.Wrapf(ctx.Err(), "drain cluster %s, %d tasks are not done", clusterID, pending)
+		case <-ticker.C():
+		}
+	}
+
+	keys := make([]taskKey, 0)
+	i.stateLock.Lock()
+	for key := range i.tasks {
+		if key.ClusterID == clusterID {
+			keys = append(keys, key)
+		}
+	}
+	i.stateLock.Unlock()
+	deleted := i.deleteTaskInfos(ctx, keys)
+	i.cleanupDeletedTasks(ctx, deleted)
+	log.Info("IndexNode drain cluster done", zap.Int("deleted", len(deleted)))
+	return nil
+}
+
+func (i *IndexNode) numPendingTasksOfCluster(clusterID string) int {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	pending := 0
+	for key, info := range i.tasks {
+		if key.ClusterID == clusterID && isPendingTask(info) {
+			pending++
+		}
+	}
+	return pending
+}
@@ -0,0 +1,163 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"strings"
+	"unsafe"
+)
+
+// indexFileKeys stores the index file keys of a task with their longest common prefix stripped,
+// as the keys of a task share a long path of bucket, collection and segment.
+// It's immutable once created, so it's safe to be copied and shared.
+type indexFileKeys struct {
+	prefix   string
+	suffixes []string
+}
+
+func newIndexFileKeys(keys []string) indexFileKeys {
+	if len(keys) == 0 {
+		return indexFileKeys{}
+	}
+	prefix := keys[0]
+	for _, key := range keys[1:] {
+		n := 0
+		for n < len(prefix) && n < len(key) && prefix[n] == key[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	suffixes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		// clone to not retain the full key
+		suffixes = append(suffixes, strings.Clone(key[len(prefix):]))
+	}
+	return indexFileKeys{
+		prefix:   strings.Clone(prefix),
+		suffixes: suffixes,
+	}
+}
+
+// memSize approximates the bytes held by the retained keys.
+func (k indexFileKeys) memSize() uint64 {
+	size := uint64(len(k.prefix)) + uint64(cap(k.suffixes))*uint64(unsafe.Sizeof(""))
+	for _, suffix := range k.suffixes {
+		size += uint64(len(suffix))
+	}
+	return size
+}
+
+// dedupFileKeys removes the duplicated keys, keeping the first occurrence of each key in order,
+// it returns keys itself if there is no duplicate.
+func dedupFileKeys(keys []string) ([]string, int) {
+	seen := make(map[string]struct{}, len(keys))
+	deduped := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		deduped = append(deduped, key)
+	}
+	if len(deduped) == len(keys) {
+		return keys, 0
+	}
+	return deduped, len(keys) - len(deduped)
+}
+
+// keys returns the full keys, the returned slice is owned by the caller.
+func (k indexFileKeys) keys() []string {
+	if k.suffixes == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(k.suffixes))
+	for _, suffix := range k.suffixes {
+		keys = append(keys, k.prefix+suffix)
+	}
+	return keys
+}
+
+func (k indexFileKeys) len() int {
+	return len(k.suffixes)
+}
+
+// sample returns the first limit keys, to be reported in the dumps and logs,
+// all the keys are returned if limit is not positive.
+func (k indexFileKeys) sample(limit int) []string {
+	if limit <= 0 || len(k.suffixes) <= limit {
+		return k.keys()
+	}
+	return indexFileKeys{prefix: k.prefix, suffixes: k.suffixes[:limit]}.keys()
+}
+
+// storeTaskFileKeys replaces the file keys of the task built with the index version,
+// the keys of the other index versions are retained, so that the files of the index formats
+// in transition are tracked side by side. It must be called before currentIndexVersion is updated.
+func storeTaskFileKeys(info *taskInfo, version int32, fileKeys indexFileKeys) {
+	if version != info.currentIndexVersion && info.fileKeys.len() > 0 {
+		if info.versionFileKeys == nil {
+			info.versionFileKeys = make(map[int32]indexFileKeys)
+		}
+		info.versionFileKeys[info.currentIndexVersion] = info.fileKeys
+	}
+	delete(info.versionFileKeys, version)
+	info.fileKeys = fileKeys
+}
+
+// taskFileKeysByVersion returns the file keys of all the index versions of the task.
+func taskFileKeysByVersion(info *taskInfo) map[int32]indexFileKeys {
+	versions := make(map[int32]indexFileKeys, len(info.versionFileKeys)+1)
+	for version, fileKeys := range info.versionFileKeys {
+		versions[version] = fileKeys
+	}
+	if info.fileKeys.len() > 0 {
+		versions[info.currentIndexVersion] = info.fileKeys
+	}
+	return versions
+}
+
+// taskFileKeys returns the file keys of the task built with the index version.
+func (i *IndexNode) taskFileKeys(clusterID string, buildID UniqueID, version int32) ([]string, bool) {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok {
+		return nil, false
+	}
+	fileKeys, ok := taskFileKeysByVersion(info)[version]
+	if !ok {
+		return nil, false
+	}
+	return fileKeys.keys(), true
+}
+
+// taskFileKeysOfAllVersions returns the file keys of the task keyed by index version.
+func (i *IndexNode) taskFileKeysOfAllVersions(clusterID string, buildID UniqueID) map[int32][]string {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok {
+		return nil
+	}
+	versions := make(map[int32][]string)
+	for version, fileKeys := range taskFileKeysByVersion(info) {
+		versions[version] = fileKeys.keys()
+	}
+	return versions
+}
@@ -0,0 +1,156 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/internal/proto/indexpb"
+	"github.com/milvus-io/milvus/pkg/log"
+)
+
+func toUnixMicro(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMicro()
+}
+
+func fromUnixMicro(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(v)
+}
+
+// ExportState serializes the tasks tracked by the index node, so that a successor process
+// keeps reporting them with ImportState on a hot upgrade. The cancel functions and hooks of the tasks are not exported.
+// The index builds run within the process and don't survive it, so the builds in flight are not resumed
+// by the successor, the tasks are restarted as Retry instead, see ImportState.
+func (i *IndexNode) ExportState() ([]byte, error) {
+	return i.DumpTasksProto()
+}
+
+// the fail reason of the imported task which was restarted as the predecessor process didn't finish it
+const importedUnfinishedReason = "index task was not done before the index node restarted"
+
+// ImportState registers the tasks exported by ExportState of a predecessor process,
+// the tasks already tracked are kept. The terminal tasks are imported as they are, so that their outcomes
+// are still reported to the coordinator. The tasks which were queued or running are restarted as Retry,
+// as their builds ended with the predecessor process and there is no build to re-attach them to,
+// so that the coordinator reassigns them and the graceful stop doesn't wait for them.
+func (i *IndexNode) ImportState(data []byte) error {
+	dump := &indexpb.IndexNodeTaskDump{}
+	if err := proto.Unmarshal(data, dump); err != nil {
+		return err
+	}
+
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	imported := 0
+	for _, snapshot := range dump.GetIndexTasks() {
+		key := taskKey{ClusterID: snapshot.GetClusterID(), BuildID: snapshot.GetInfo().GetBuildID()}
+		if key.ClusterID == "" || key.BuildID <= 0 {
+			log.Warn("IndexNode skip invalid imported task",
+				zap.String("clusterID", key.ClusterID), zap.Int64("buildID", key.BuildID))
+			continue
+		}
+		if _, ok := i.tasks[key]; ok {
+			log.Warn("IndexNode skip imported task which already exists",
+				zap.String("clusterID", key.ClusterID), zap.Int64("buildID", key.BuildID))
+			continue
+		}
+		info := &taskInfo{
+			key:                 key,
+			state:               snapshot.GetInfo().GetState(),
+			fileKeys:            newIndexFileKeys(snapshot.GetInfo().GetIndexFileKeys()),
+			serializedSize:      snapshot.GetInfo().GetSerializedSize(),
+			failReason:          snapshot.GetInfo().GetFailReason(),
+			currentIndexVersion: snapshot.GetInfo().GetCurrentIndexVersion(),
+			indexStoreVersion:   snapshot.GetInfo().GetIndexStoreVersion(),
+			versionFileKeys:     versionFileKeysFromProto(snapshot.GetVersionFileKeys()),
+			createTime:          fromUnixMicro(snapshot.GetCreateTime()),
+			startTime:           fromUnixMicro(snapshot.GetStartTime()),
+			endTime:             fromUnixMicro(snapshot.GetEndTime()),
+			cancelled:           snapshot.GetCancelled(),
+			cancelReason:        snapshot.GetCancelReason(),
+			segmentIDs:          snapshot.GetSegmentIDs(),
+			workerID:            snapshot.GetWorkerID(),
+			isRebuild:           snapshot.GetIsRebuild(),
+			diagnostics:         snapshot.GetDiagnostics(),
+			statistic:           snapshot.GetStatistic(),
+		}
+		if info.createTime.IsZero() {
+			info.createTime = i.clock.Now()
+		}
+		if !isTerminalState(info.state) {
+			log.Warn("IndexNode restart unfinished imported task as retry", zap.String("clusterID", key.ClusterID),
+				zap.Int64("buildID", key.BuildID), zap.String("state", info.state.String()))
+			info.state = commonpb.IndexState_Retry
+			info.failReason = importedUnfinishedReason
+			info.endTime = i.clock.Now()
+		}
+		i.tasks[key] = info
+		i.clusterTaskCounts[key.ClusterID]++
+		i.markTaskChanged(info)
+		i.buildClusters[key.BuildID] = key.ClusterID
+		i.clusterSerializedSizes[key.ClusterID] += info.serializedSize
+		for _, segmentID := range info.segmentIDs {
+			i.segmentTasks[segmentID] = key
+		}
+		switch info.state {
+		case commonpb.IndexState_Finished:
+			i.updateLatestFinished(key, info)
+		case commonpb.IndexState_Failed:
+			i.clusterFailedTasks[key.ClusterID] = append(i.clusterFailedTasks[key.ClusterID], key)
+		}
+		imported++
+	}
+	log.Info("IndexNode import task state", zap.Int("total", len(dump.GetIndexTasks())), zap.Int("imported", imported))
+	return nil
+}
+
+// versionFileKeysToProto converts the retained file keys of the index versions, sorted by index version.
+func versionFileKeysToProto(versionFileKeys map[int32]indexFileKeys) []*indexpb.IndexVersionFileKeys {
+	versions := maps.Keys(versionFileKeys)
+	slices.Sort(versions)
+	result := make([]*indexpb.IndexVersionFileKeys, 0, len(versions))
+	for _, version := range versions {
+		result = append(result, &indexpb.IndexVersionFileKeys{
+			CurrentIndexVersion: version,
+			IndexFileKeys:       versionFileKeys[version].keys(),
+		})
+	}
+	return result
+}
+
+func versionFileKeysFromProto(versionFileKeys []*indexpb.IndexVersionFileKeys) map[int32]indexFileKeys {
+	if len(versionFileKeys) == 0 {
+		return nil
+	}
+	result := make(map[int32]indexFileKeys, len(versionFileKeys))
+	for _, fileKeys := range versionFileKeys {
+		result[fileKeys.GetCurrentIndexVersion()] = newIndexFileKeys(fileKeys.GetIndexFileKeys())
+	}
+	return result
+}
@@ -0,0 +1,123 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"github.com/cockroachdb/errors"
+	"golang.org/x/exp/maps"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/pkg/util/merr"
+	"github.com/milvus-io/milvus/pkg/util/typeutil"
+)
+
+// checkInvariants verifies the state derived from the tasks matches a recomputation from them,
+// it's meant to be called by tests to detect drifts of the bookkeeping.
+// The metrics are not verified, as they are shared by all the index nodes in the process.
+func (i *IndexNode) checkInvariants() error {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	errs := make([]error, 0)
+
+	sizes := make(map[string]uint64)
+	counts := make(map[string]int)
+	for key, info := range i.tasks {
+		sizes[key.ClusterID] += info.serializedSize
+		counts[key.ClusterID]++
+		if info.key != key {
+			errs = append(errs, errors.Newf("task %v is stored with key %v", key, info.key))
+		}
+		if _, ok := i.buildClusters[key.BuildID]; !ok {
+			errs = append(errs, errors.Newf("build of task %v is not indexed", key))
+		}
+		for _, segmentID := range info.segmentIDs {
+			if _, ok := i.segmentTasks[segmentID]; !ok {
+				errs = append(errs, errors.Newf("segment %d of task %v is not indexed", segmentID, key))
+			}
+		}
+		if info.generation > i.generation {
+			errs = append(errs, errors.Newf("generation %d of task %v is ahead of the node generation %d",
+				info.generation, key, i.generation))
+		}
+	}
+	for buildID, clusterID := range i.buildClusters {
+		if _, ok := i.tasks[taskKey{ClusterID: clusterID, BuildID: buildID}]; !ok {
+			errs = append(errs, errors.Newf("build %d is indexed to cluster %s without task", buildID, clusterID))
+		}
+	}
+	for segmentID, key := range i.segmentTasks {
+		if info, ok := i.tasks[key]; !ok || !typeutil.NewSet(info.segmentIDs...).Contain(segmentID) {
+			errs = append(errs, errors.Newf("segment %d is indexed to task %v which doesn't cover it", segmentID, key))
+		}
+	}
+	if !maps.Equal(counts, i.clusterTaskCounts) {
+		errs = append(errs, errors.Newf("task counts of clusters are %v, expected %v", i.clusterTaskCounts, counts))
+	}
+	for clusterID, size := range i.clusterSerializedSizes {
+		if sizes[clusterID] != size {
+			errs = append(errs, errors.Newf("serialized size of cluster %s is %d, expected %d", clusterID, size, sizes[clusterID]))
+		}
+	}
+	for clusterID, size := range sizes {
+		if _, ok := i.clusterSerializedSizes[clusterID]; !ok && size > 0 {
+			errs = append(errs, errors.Newf("serialized size of cluster %s is not tracked, expected %d", clusterID, size))
+		}
+	}
+	for clusterID, key := range i.latestFinished {
+		if _, ok := i.tasks[key]; !ok || key.ClusterID != clusterID {
+			errs = append(errs, errors.Newf("latest finished task %v of cluster %s doesn't exist", key, clusterID))
+		}
+	}
+	for clusterID, keys := range i.clusterFailedTasks {
+		seen := make(map[taskKey]struct{}, len(keys))
+		for _, key := range keys {
+			if _, ok := seen[key]; ok {
+				errs = append(errs, errors.Newf("failed task %v of cluster %s is retained twice", key, clusterID))
+			}
+			seen[key] = struct{}{}
+			if info, ok := i.tasks[key]; !ok || info.state != commonpb.IndexState_Failed || key.ClusterID != clusterID {
+				errs = append(errs, errors.Newf("retained failed task %v of cluster %s doesn't exist or isn't failed", key, clusterID))
+			}
+		}
+	}
+	for clusterID, count := range i.terminalTaskCounts {
+		if _, ok := counts[clusterID]; !ok {
+			errs = append(errs, errors.Newf("terminal tasks of cluster %s without task are counted", clusterID))
+		}
+		if count.cancelled > count.total {
+			errs = append(errs, errors.Newf("cancelled tasks %d of cluster %s exceed the terminal tasks %d",
+				count.cancelled, clusterID, count.total))
+		}
+	}
+	for clusterID, outcomes := range i.recentOutcomes {
+		if _, ok := counts[clusterID]; !ok {
+			errs = append(errs, errors.Newf("recent outcomes of cluster %s without task are kept", clusterID))
+		}
+		if len(outcomes.outcomes) > maxRecentOutcomesPerCluster {
+			errs = append(errs, errors.Newf("%d recent outcomes of cluster %s exceed the limit", len(outcomes.outcomes), clusterID))
+		}
+	}
+	for clusterID := range i.stateLogLimiters {
+		if _, ok := counts[clusterID]; !ok {
+			errs = append(errs, errors.Newf("state log limiter of cluster %s without task is kept", clusterID))
+		}
+	}
+	if len(errs) > 0 {
+		return merr.Combine(errs...)
+	}
+	return nil
+}
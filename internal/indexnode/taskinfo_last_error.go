@@ -0,0 +1,48 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// ClusterError is the last failure of the tasks of a cluster.
+type ClusterError struct {
+	BuildID    UniqueID
+	FailReason string
+	Time       time.Time
+}
+
+// recordClusterError records the failure of the task as the last error of its cluster,
+// stateLock must be held by the caller.
+func (i *IndexNode) recordClusterError(key taskKey, failReason string) {
+	i.lastClusterErrors[key.ClusterID] = ClusterError{
+		BuildID:    key.BuildID,
+		FailReason: failReason,
+		Time:       i.clock.Now(),
+	}
+}
+
+// lastErrorPerCluster returns the last failure of the tasks per cluster, the cancelled tasks are not counted.
+// The last error of a cluster is kept after the failed task is deleted, until the cluster has no task left.
+func (i *IndexNode) lastErrorPerCluster() map[string]ClusterError {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	return maps.Clone(i.lastClusterErrors)
+}
@@ -2,27 +2,105 @@ package indexnode
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unsafe"
 
 	"github.com/golang/protobuf/proto"
 	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 
 	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
 	"github.com/milvus-io/milvus/internal/proto/indexpb"
-	"github.com/milvus-io/milvus/pkg/common"
 	"github.com/milvus-io/milvus/pkg/log"
+	"github.com/milvus-io/milvus/pkg/metrics"
+	"github.com/milvus-io/milvus/pkg/util/conc"
+	"github.com/milvus-io/milvus/pkg/util/merr"
+	"github.com/milvus-io/milvus/pkg/util/paramtable"
+	"github.com/milvus-io/milvus/pkg/util/ratelimitutil"
 )
 
-func (i *IndexNode) loadOrStoreTask(ClusterID string, buildID UniqueID, info *taskInfo) *taskInfo {
+// loadOrStoreTask returns the existing task with the same key, or stores info and returns nil.
+// It returns an error if the cluster or build ID is invalid, the cluster is draining, or the build is quarantined.
+// If the deleted task with the same key is still being cleaned up, it waits for the cleanup up to
+// TaskDeletionWaitTimeout, and returns errTaskBusy if the cleanup is not done in time. The decision is recorded in the recent admission decisions.
+func (i *IndexNode) loadOrStoreTask(ClusterID string, buildID UniqueID, info *taskInfo) (*taskInfo, error) {
+	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	if err := i.waitTaskCleanedUp(key); err != nil {
+		i.stateLock.Lock()
+		i.recordAdmission(key, admissionRejectedBusy, err.Error())
+		i.stateLock.Unlock()
+		return nil, err
+	}
 	i.stateLock.Lock()
 	defer i.stateLock.Unlock()
-	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	if ClusterID == "" {
+		err := merr.WrapErrParameterInvalidMsg("clusterID of index task is empty, buildID=%d", buildID)
+		i.recordAdmission(key, admissionRejectedInvalid, err.Error())
+		return nil, err
+	}
+	if buildID <= 0 {
+		err := merr.WrapErrParameterInvalidMsg("buildID of index task must be positive, clusterID=%s, buildID=%d", ClusterID, buildID)
+		i.recordAdmission(key, admissionRejectedInvalid, err.Error())
+		return nil, err
+	}
 	oldInfo, ok := i.tasks[key]
+	if ok && !isReconciledPlaceholder(oldInfo) {
+		i.recordAdmission(key, admissionRejectedDuplicate, "task exists in state "+oldInfo.state.String())
+		if oldInfo.currentIndexVersion != info.currentIndexVersion || oldInfo.indexStoreVersion != info.indexStoreVersion {
+			log.Warn("IndexNode receive index task with different versions from the existing one",
+				zap.String("clusterID", ClusterID), zap.Int64("buildID", buildID), zap.String("state", oldInfo.state.String()),
+				zap.Int32("currentIndexVersion", oldInfo.currentIndexVersion), zap.Int32("newCurrentIndexVersion", info.currentIndexVersion),
+				zap.Int64("indexStoreVersion", oldInfo.indexStoreVersion), zap.Int64("newIndexStoreVersion", info.indexStoreVersion))
+		}
+		return oldInfo, nil
+	}
+	if _, ok := i.drainingClusters[ClusterID]; ok {
+		err := merr.WrapErrServiceUnavailable("cluster is draining", fmt.Sprintf("clusterID=%s, buildID=%d", ClusterID, buildID))
+		i.recordAdmission(key, admissionRejectedDraining, err.Error())
+		return nil, err
+	}
+	if err := i.checkBuildQuarantined(buildID); err != nil {
+		i.recordAdmission(key, admissionRejectedQuarantine, err.Error())
+		return nil, err
+	}
+	if err := i.checkClusterLimit(key); err != nil {
+		i.recordAdmission(key, admissionRejectedClusterLimit, err.Error())
+		return nil, err
+	}
+	if info.createTime.IsZero() {
+		info.createTime = i.clock.Now()
+	}
 	if ok {
-		return oldInfo
+		// the waiters of the placeholder go on waiting for the task replacing it
+		notifyTaskWaiters(oldInfo)
+	} else {
+		i.clusterTaskCounts[ClusterID]++
 	}
+	info.key = key
 	i.tasks[key] = info
-	return nil
+	i.markTaskChanged(info)
+	i.buildClusters[buildID] = ClusterID
+	for _, segmentID := range info.segmentIDs {
+		i.segmentTasks[segmentID] = key
+	}
+	i.recordAdmission(key, admissionAdmitted, "")
+	i.recordRegistration(info)
+	return nil, nil
+}
+
+// clusterForBuild returns the cluster of the task with buildID.
+// BuildID is expected to be unique across clusters, in the rare case that it's not,
+// the cluster registered last wins, and the lookup misses once that task is deleted.
+func (i *IndexNode) clusterForBuild(buildID UniqueID) (string, bool) {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	clusterID, ok := i.buildClusters[buildID]
+	return clusterID, ok
 }
 
 func (i *IndexNode) loadTaskState(ClusterID string, buildID UniqueID) commonpb.IndexState {
@@ -36,18 +114,357 @@ func (i *IndexNode) loadTaskState(ClusterID string, buildID UniqueID) commonpb.I
 	return task.state
 }
 
-func (i *IndexNode) storeTaskState(ClusterID string, buildID UniqueID, state commonpb.IndexState, failReason string) {
+func (i *IndexNode) storeTaskState(ctx context.Context, ClusterID string, buildID UniqueID, state commonpb.IndexState, failReason string) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	// the evicted failed tasks are cleaned up after stateLock is released
+	var evicted []*taskInfo
+	defer func() {
+		if len(evicted) > 0 {
+			i.cleanupDeletedTasks(ctx, evicted)
+		}
+	}()
 	i.stateLock.Lock()
 	defer i.stateLock.Unlock()
 	if task, ok := i.tasks[key]; ok {
-		log.Debug("IndexNode store task state", zap.String("clusterID", ClusterID), zap.Int64("buildID", buildID),
-			zap.String("state", state.String()), zap.String("fail reason", failReason))
-		task.state = state
+		evicted = i.setTaskStateLocked(ctx, key, task, state, failReason)
+		return
+	}
+	if deletedAt, ok := i.tombstones.get(key); ok {
+		log.Ctx(ctx).Warn("IndexNode receive update for deleted task", zap.String("clusterID", ClusterID), zap.Int64("buildID", buildID),
+			zap.String("state", state.String()), zap.Duration("sinceDeleted", i.clock.Since(deletedAt)))
+	}
+}
+
+// setTaskStateLocked moves the task to state, and returns the failed tasks evicted to make room for it,
+// which should be cleaned up after stateLock is released. stateLock must be held by the caller.
+// A terminal task keeps its state and fail reason, e.g. the Retry reported by a build cancelled by failAllInProgress
+// doesn't override its Failed, the task is only reset by deleting it and registering it again.
+func (i *IndexNode) setTaskStateLocked(ctx context.Context, key taskKey, task *taskInfo, state commonpb.IndexState, failReason string) []*taskInfo {
+	if isTerminalState(task.state) {
+		log.Ctx(ctx).Info("IndexNode ignore state change of terminal task",
+			zap.String("clusterID", key.ClusterID), zap.Int64("buildID", key.BuildID),
+			zap.String("state", task.state.String()), zap.String("ignoredState", state.String()))
+		return nil
+	}
+	var evicted []*taskInfo
+	if state == commonpb.IndexState_Finished && !hasIndexFiles(task) {
+		log.Ctx(ctx).Error("IndexNode index task finished without index files",
+			zap.String("clusterID", key.ClusterID), zap.Int64("buildID", key.BuildID))
+		if Params.IndexNodeCfg.FailFinishedTaskWithoutFiles.GetAsBool() {
+			state, failReason = commonpb.IndexState_Failed, finishedWithoutFilesReason
+		}
+	}
+	i.logTaskStateChange(ctx, key, state, failReason)
+	if !task.stateUpdated {
+		task.stateUpdated = true
+		metrics.IndexNodeTaskFirstUpdateLatency.WithLabelValues(strconv.FormatInt(paramtable.GetNodeID(), 10), key.ClusterID).
+			Observe(float64(i.clock.Since(task.createTime).Milliseconds()))
+	}
+	if state == commonpb.IndexState_InProgress && task.startTime.IsZero() {
+		task.startTime = i.clock.Now()
+	}
+	if isTerminalState(state) {
+		task.endTime = i.clock.Now()
+		i.countTerminalTask(key, task.cancelled)
+		i.recordTaskOutcome(key, state, task.cancelled)
+		notifyTaskWaiters(task)
+	}
+	if state == commonpb.IndexState_Finished {
+		i.updateLatestFinished(key, task)
+		observeFinishedTaskStats(key, task.statistic)
+	}
+	if state == commonpb.IndexState_Failed && !task.cancelled {
+		i.recordClusterError(key, failReason)
+	}
+	if (state == commonpb.IndexState_Failed || state == commonpb.IndexState_Retry) && !task.cancelled {
+		i.recordBuildFailure(key, failReason)
+	} else if state == commonpb.IndexState_Finished {
+		delete(i.buildFailures, key.BuildID)
+	}
+	task.state = state
+	i.markTaskChanged(task)
+	if !task.cancelled {
 		task.failReason = failReason
 	}
+	task.version++
+	if state == commonpb.IndexState_Failed {
+		evicted = i.retainFailedTask(ctx, key)
+	}
+	return evicted
+}
+
+// the fail reason of the task finishing without index files
+const finishedWithoutFilesReason = "index task finished without index files"
+
+// hasIndexFiles returns whether the task has produced any index file. The tasks built into the storage v2
+// don't report file keys, as their index files are tracked by indexStoreVersion of the space.
+func hasIndexFiles(info *taskInfo) bool {
+	return info.fileKeys.len() > 0 || info.indexStoreVersion > 0
+}
+
+// finishedTasksWithNoFiles returns the keys of the finished tasks without any index file,
+// sorted by cluster and build ID.
+func (i *IndexNode) finishedTasksWithNoFiles() []taskKey {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	keys := make([]taskKey, 0)
+	for key, info := range i.tasks {
+		if info.state == commonpb.IndexState_Finished && !hasIndexFiles(info) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(x, y int) bool {
+		return lessTaskKey(keys[x], keys[y])
+	})
+	return keys
+}
+
+// indexTaskElapsed returns how long the task has run, until now for a running task,
+// or until it reached the terminal state for a terminal task.
+func (i *IndexNode) indexTaskElapsed(clusterID string, buildID UniqueID) (time.Duration, bool) {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok {
+		return 0, false
+	}
+	if isTerminalState(info.state) && !info.endTime.IsZero() {
+		return info.endTime.Sub(info.createTime), true
+	}
+	return i.clock.Since(info.createTime), true
+}
+
+// stateLogLimiter rate limits the task state change logs of a cluster.
+type stateLogLimiter struct {
+	limiter *ratelimitutil.Limiter
+	// number of the logs suppressed since the last emitted one
+	suppressed int64
 }
 
+// logTaskStateChange logs the state change of a task. The logs are rate limited per cluster by StateChangeLogRate,
+// and the number of logs suppressed since the last emitted one is attached to the next emitted log.
+// The limiters are owned by the index node, and dropped along with the cluster by untrackClusterTask.
+// stateLock must be held by the caller.
+func (i *IndexNode) logTaskStateChange(ctx context.Context, key taskKey, state commonpb.IndexState, failReason string) {
+	fields := []zap.Field{
+		zap.String("clusterID", key.ClusterID), zap.Int64("buildID", key.BuildID),
+		zap.String("state", state.String()), zap.String("fail reason", failReason),
+	}
+	rate := Params.IndexNodeCfg.StateChangeLogRate.GetAsFloat()
+	if rate <= 0 {
+		log.Ctx(ctx).Debug("IndexNode store task state", fields...)
+		return
+	}
+	limiter, ok := i.stateLogLimiters[key.ClusterID]
+	if !ok {
+		limiter = &stateLogLimiter{}
+		i.stateLogLimiters[key.ClusterID] = limiter
+	}
+	// the limiter is replaced rather than reconfigured on a rate change, as SetLimit runs on the wall clock
+	if limiter.limiter == nil || limiter.limiter.Limit() != ratelimitutil.Limit(rate) {
+		limiter.limiter = ratelimitutil.NewLimiter(ratelimitutil.Limit(rate), rate)
+	}
+	if !limiter.limiter.AllowN(i.clock.Now(), 1) {
+		limiter.suppressed++
+		return
+	}
+	log.Ctx(ctx).Debug("IndexNode store task state", append(fields, zap.Int64("suppressed", limiter.suppressed))...)
+	limiter.suppressed = 0
+}
+
+// dequeueForExecution moves the queued tasks of keys to InProgress under stateLock, and returns the ones moved.
+// The tasks which are not queued anymore, e.g. cancelled, failed or deleted while queued, are skipped so that
+// they are not run, and so are the reconciled placeholders. The build slots of the tasks are acquired by the caller.
+func (i *IndexNode) dequeueForExecution(ctx context.Context, keys []taskKey) []taskKey {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	dequeued := make([]taskKey, 0, len(keys))
+	for _, key := range keys {
+		info, ok := i.tasks[key]
+		if !ok || info.state != commonpb.IndexState_Unissued || info.cancelled || info.reconciled {
+			state := commonpb.IndexState_IndexStateNone
+			if ok {
+				state = info.state
+			}
+			log.Ctx(ctx).Info("IndexNode skip dequeuing task which is not queued", zap.String("clusterID", key.ClusterID),
+				zap.Int64("buildID", key.BuildID), zap.String("state", state.String()), zap.Bool("cancelled", ok && info.cancelled))
+			continue
+		}
+		i.setTaskStateLocked(ctx, key, info, commonpb.IndexState_InProgress, "")
+		dequeued = append(dequeued, key)
+	}
+	return dequeued
+}
+
+// storeTaskWorker records the scheduler worker which picks up the task.
+func (i *IndexNode) storeTaskWorker(ClusterID string, buildID UniqueID, workerID string) {
+	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	if info, ok := i.tasks[key]; ok {
+		info.workerID = workerID
+	}
+}
+
+// reportTaskActualMem records the resident memory of the native build of the task,
+// it's called periodically by the native layer while the task is running.
+func (i *IndexNode) reportTaskActualMem(ClusterID string, buildID UniqueID, bytes uint64) {
+	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	if info, ok := i.tasks[key]; ok {
+		info.actualMem = bytes
+	}
+}
+
+// totalActualMemInProgress returns the total resident memory reported by the running tasks.
+func (i *IndexNode) totalActualMemInProgress() uint64 {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	total := uint64(0)
+	for _, info := range i.tasks {
+		if info.state == commonpb.IndexState_InProgress {
+			total += info.actualMem
+		}
+	}
+	return total
+}
+
+// cancelTask cancels the running task and records the reason, the task is kept until it's dropped.
+// It returns false if the task doesn't exist, has already reached a terminal state, or is uncancellable.
+func (i *IndexNode) cancelTask(ClusterID string, buildID UniqueID, reason string) bool {
+	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok || isTerminalState(info.state) {
+		return false
+	}
+	return cancelTaskLocked(key, info, reason)
+}
+
+// setTaskUncancellable marks the task uncancellable while it's in a critical section, in which cancelling it
+// would corrupt the partial output, and unmarks it once the critical section is done.
+func (i *IndexNode) setTaskUncancellable(clusterID string, buildID UniqueID, v bool) {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	if info, ok := i.tasks[key]; ok {
+		info.uncancellable = v
+	}
+}
+
+// canCancel returns whether cancelling the task takes effect, i.e. the task exists, hasn't reached
+// a terminal state, isn't uncancellable, and has a cancel func.
+func (i *IndexNode) canCancel(clusterID string, buildID UniqueID) bool {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	return ok && !isTerminalState(info.state) && !info.uncancellable && info.cancel != nil
+}
+
+// cancelIndexTasks cancels the queued or running tasks of keys under one lock acquisition,
+// and returns the number of tasks cancelled.
+func (i *IndexNode) cancelIndexTasks(keys []taskKey) int {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	cancelled := 0
+	for _, key := range keys {
+		if info, ok := i.tasks[key]; ok && isPendingTask(info) && cancelTaskLocked(key, info, "cancelled by request") {
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// cancelLongestRunningTask cancels the task running the longest to relieve the pressure of the node,
+// the tasks already cancelled or uncancellable are skipped. It returns false if no task is running.
+func (i *IndexNode) cancelLongestRunningTask() (taskKey, bool) {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	var longest taskKey
+	var longestInfo *taskInfo
+	for key, info := range i.tasks {
+		if info.state != commonpb.IndexState_InProgress || info.cancelled {
+			continue
+		}
+		if info.uncancellable {
+			log.Info("IndexNode skip shedding uncancellable task", zap.String("clusterID", key.ClusterID),
+				zap.Int64("buildID", key.BuildID))
+			continue
+		}
+		if longestInfo == nil || info.startTime.Before(longestInfo.startTime) ||
+			(info.startTime.Equal(longestInfo.startTime) && key.BuildID < longest.BuildID) {
+			longest, longestInfo = key, info
+		}
+	}
+	if longestInfo == nil {
+		return taskKey{}, false
+	}
+	cancelTaskLocked(longest, longestInfo, "shed for pressure")
+	return longest, true
+}
+
+// cancelTaskLocked records the cancel reason and cancels the task, it returns false without cancelling
+// if the task is uncancellable. stateLock must be held by the caller.
+func cancelTaskLocked(key taskKey, info *taskInfo, reason string) bool {
+	if info.uncancellable {
+		log.Info("IndexNode skip cancelling uncancellable task", zap.String("clusterID", key.ClusterID),
+			zap.Int64("buildID", key.BuildID), zap.String("reason", reason))
+		return false
+	}
+	if !info.cancelled {
+		info.cancelled = true
+		info.cancelReason = reason
+		info.version++
+	}
+	if info.cancel != nil {
+		info.cancel()
+	}
+	log.Info("IndexNode cancel index task", zap.String("clusterID", key.ClusterID), zap.Int64("buildID", key.BuildID),
+		zap.String("reason", reason))
+	return true
+}
+
+// updateLatestFinished records the task as the latest finished one of its cluster if it ends later.
+// stateLock must be held by the caller.
+func (i *IndexNode) updateLatestFinished(key taskKey, info *taskInfo) {
+	latest, ok := i.tasks[i.latestFinished[key.ClusterID]]
+	if !ok || latest.state != commonpb.IndexState_Finished || !info.endTime.Before(latest.endTime) {
+		i.latestFinished[key.ClusterID] = key
+	}
+}
+
+// latestFinishedTask returns the snapshot of the most recently finished task of the cluster.
+func (i *IndexNode) latestFinishedTask(clusterID string) (IndexTaskSnapshot, bool) {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	if key, ok := i.latestFinished[clusterID]; ok {
+		if info, ok := i.tasks[key]; ok && info.state == commonpb.IndexState_Finished {
+			return newIndexTaskSnapshot(key, info), true
+		}
+		delete(i.latestFinished, clusterID)
+	}
+	// the cached task is gone, fall back to a scan
+	for key, info := range i.tasks {
+		if key.ClusterID == clusterID && info.state == commonpb.IndexState_Finished {
+			i.updateLatestFinished(key, info)
+		}
+	}
+	key, ok := i.latestFinished[clusterID]
+	if !ok {
+		return IndexTaskSnapshot{}, false
+	}
+	return newIndexTaskSnapshot(key, i.tasks[key]), true
+}
+
+// foreachTaskInfo calls fn with the live tasks under stateLock, it's reserved for mutating the tasks.
+// fn must not retain info after it returns, use foreachTaskSnapshot to read the tasks instead.
 func (i *IndexNode) foreachTaskInfo(fn func(ClusterID string, buildID UniqueID, info *taskInfo)) {
 	i.stateLock.Lock()
 	defer i.stateLock.Unlock()
@@ -63,17 +480,85 @@ func (i *IndexNode) storeIndexFilesAndStatistic(
 	serializedSize uint64,
 	statistic *indexpb.JobInfo,
 	currentIndexVersion int32,
-) {
+) error {
+	ctx := context.Background()
 	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	var evicted []*taskInfo
+	defer func() {
+		if len(evicted) > 0 {
+			i.cleanupDeletedTasks(ctx, evicted)
+		}
+	}()
 	i.stateLock.Lock()
 	defer i.stateLock.Unlock()
 	if info, ok := i.tasks[key]; ok {
-		info.fileKeys = common.CloneStringList(fileKeys)
+		var err error
+		if evicted, err = i.accountClusterSerializedSize(ctx, key, info, serializedSize); err != nil {
+			return err
+		}
+		storeTaskFileKeys(info, currentIndexVersion, newTaskFileKeys(key, fileKeys))
 		info.serializedSize = serializedSize
-		info.statistic = proto.Clone(statistic).(*indexpb.JobInfo)
+		i.storeStatistic(key, info, statistic)
 		info.currentIndexVersion = currentIndexVersion
-		return
+		info.version++
+	}
+	return nil
+}
+
+// loadTaskVersion returns the version of the task, to be passed to storeIndexFilesAndStatisticWithVersion.
+func (i *IndexNode) loadTaskVersion(ClusterID string, buildID UniqueID) (uint64, bool) {
+	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok {
+		return 0, false
+	}
+	return info.version, true
+}
+
+// storeIndexFilesAndStatisticWithVersion is like storeIndexFilesAndStatistic,
+// but rejects the write if the task has been mutated since expectedVersion was loaded.
+func (i *IndexNode) storeIndexFilesAndStatisticWithVersion(
+	ClusterID string,
+	buildID UniqueID,
+	expectedVersion uint64,
+	fileKeys []string,
+	serializedSize uint64,
+	statistic *indexpb.JobInfo,
+	currentIndexVersion int32,
+) error {
+	ctx := context.Background()
+	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	var evicted []*taskInfo
+	defer func() {
+		if len(evicted) > 0 {
+			i.cleanupDeletedTasks(ctx, evicted)
+		}
+	}()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok {
+		return nil
+	}
+	if info.version != expectedVersion {
+		err := merr.WrapErrParameterInvalid(expectedVersion, info.version,
+			fmt.Sprintf("conflicting write to index task, clusterID=%s, buildID=%d", ClusterID, buildID))
+		log.Warn("IndexNode reject index files of task", zap.String("clusterID", ClusterID),
+			zap.Int64("buildID", buildID), zap.Error(err))
+		return err
+	}
+	var err error
+	if evicted, err = i.accountClusterSerializedSize(ctx, key, info, serializedSize); err != nil {
+		return err
 	}
+	storeTaskFileKeys(info, currentIndexVersion, newTaskFileKeys(key, fileKeys))
+	info.serializedSize = serializedSize
+	i.storeStatistic(key, info, statistic)
+	info.currentIndexVersion = currentIndexVersion
+	info.version++
+	return nil
 }
 
 func (i *IndexNode) storeIndexFilesAndStatisticV2(
@@ -84,18 +569,348 @@ func (i *IndexNode) storeIndexFilesAndStatisticV2(
 	statistic *indexpb.JobInfo,
 	currentIndexVersion int32,
 	indexStoreVersion int64,
-) {
+) error {
+	ctx := context.Background()
 	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	var evicted []*taskInfo
+	defer func() {
+		if len(evicted) > 0 {
+			i.cleanupDeletedTasks(ctx, evicted)
+		}
+	}()
 	i.stateLock.Lock()
 	defer i.stateLock.Unlock()
 	if info, ok := i.tasks[key]; ok {
-		info.fileKeys = common.CloneStringList(fileKeys)
+		var err error
+		if evicted, err = i.accountClusterSerializedSize(ctx, key, info, serializedSize); err != nil {
+			return err
+		}
+		storeTaskFileKeys(info, currentIndexVersion, newTaskFileKeys(key, fileKeys))
 		info.serializedSize = serializedSize
-		info.statistic = proto.Clone(statistic).(*indexpb.JobInfo)
+		i.storeStatistic(key, info, statistic)
 		info.currentIndexVersion = currentIndexVersion
 		info.indexStoreVersion = indexStoreVersion
+		info.version++
+	}
+	return nil
+}
+
+// inconsistentVersionTasks returns the keys of the tasks whose versions are inconsistent, sorted by cluster and
+// build ID. The versions of a task are consistent if all of the following hold:
+//   - neither currentIndexVersion nor indexStoreVersion is negative;
+//   - currentIndexVersion is positive if indexStoreVersion is, as the index files of a store version are always built
+//     by a versioned index engine. The other way around is consistent, as the store path of V1 keeps indexStoreVersion 0;
+//   - the file keys retained per version don't include currentIndexVersion, whose keys are kept in fileKeys.
+func (i *IndexNode) inconsistentVersionTasks() []taskKey {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	keys := make([]taskKey, 0)
+	for key, info := range i.tasks {
+		_, retained := info.versionFileKeys[info.currentIndexVersion]
+		if info.currentIndexVersion < 0 || info.indexStoreVersion < 0 ||
+			(info.indexStoreVersion > 0 && info.currentIndexVersion == 0) || retained {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(x, y int) bool {
+		return lessTaskKey(keys[x], keys[y])
+	})
+	return keys
+}
+
+// failIndexTask marks the task failed, and attaches the diagnostics of the failure, e.g. the last log lines
+// or a resource snapshot, under one lock acquisition, so that readers never observe a failed task without them.
+func (i *IndexNode) failIndexTask(ctx context.Context, clusterID string, buildID UniqueID, reason string, diag map[string]string) {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	var evicted []*taskInfo
+	defer func() {
+		if len(evicted) > 0 {
+			i.cleanupDeletedTasks(ctx, evicted)
+		}
+	}()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok {
 		return
 	}
+	info.diagnostics = maps.Clone(diag)
+	evicted = i.setTaskStateLocked(ctx, key, info, commonpb.IndexState_Failed, reason)
+}
+
+// failAllInProgress marks all the running tasks failed with reason and stops their builds,
+// under one lock acquisition, e.g. when the storage backend is unreachable. It returns the number of failed tasks.
+// The uncancellable tasks are skipped, they report their own outcomes once the critical sections are done.
+func (i *IndexNode) failAllInProgress(reason string) int {
+	ctx := context.Background()
+	var evicted []*taskInfo
+	defer func() {
+		if len(evicted) > 0 {
+			i.cleanupDeletedTasks(ctx, evicted)
+		}
+	}()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	failed := 0
+	for key, info := range i.tasks {
+		if info.state != commonpb.IndexState_InProgress {
+			continue
+		}
+		if info.uncancellable {
+			log.Info("IndexNode skip failing uncancellable task", zap.String("clusterID", key.ClusterID),
+				zap.Int64("buildID", key.BuildID))
+			continue
+		}
+		if info.cancel != nil {
+			info.cancel()
+		}
+		evicted = append(evicted, i.setTaskStateLocked(ctx, key, info, commonpb.IndexState_Failed, reason)...)
+		failed++
+	}
+	log.Warn("IndexNode fail all the running tasks", zap.Int("failed", failed), zap.String("reason", reason))
+	return failed
+}
+
+// newTaskFileKeys retains all the index file keys of a task, as the coordinator takes them as the complete index,
+// only a sample of them is reported in the dumps and logs if the number of keys exceeds MaxDumpedIndexFileKeys.
+func newTaskFileKeys(key taskKey, fileKeys []string) indexFileKeys {
+	fileKeys, dupes := dedupFileKeys(fileKeys)
+	if dupes > 0 {
+		log.Warn("IndexNode drop duplicated index file keys of task", zap.String("clusterID", key.ClusterID),
+			zap.Int64("buildID", key.BuildID), zap.Int("duplicated", dupes))
+	}
+	limit := Params.IndexNodeCfg.MaxDumpedIndexFileKeys.GetAsInt()
+	if limit > 0 && len(fileKeys) > limit {
+		log.Warn("IndexNode dump a sample of the index file keys of task", zap.String("clusterID", key.ClusterID),
+			zap.Int64("buildID", key.BuildID), zap.Int("numFileKeys", len(fileKeys)), zap.Int("dumped", limit))
+	}
+	return newIndexFileKeys(fileKeys)
+}
+
+// dedupTaskFiles removes the duplicated index file keys of the task, and returns how many are removed.
+// The serialized size of the task is kept, as the sizes of the individual files are not known.
+func (i *IndexNode) dedupTaskFiles(clusterID string, buildID UniqueID) int {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok {
+		return 0
+	}
+	keys, dupes := dedupFileKeys(info.fileKeys.keys())
+	if dupes == 0 {
+		return 0
+	}
+	info.fileKeys = newIndexFileKeys(keys)
+	info.version++
+	return dupes
+}
+
+// IndexResult is the output of an index build task.
+type IndexResult struct {
+	FileKeys            []string
+	SerializedSize      uint64
+	Statistic           *indexpb.JobInfo
+	CurrentIndexVersion int32
+	IndexStoreVersion   int64
+}
+
+// finishIndexTask stores the result and marks the task finished under one lock acquisition,
+// so that readers never observe the index files of a task which is still in progress.
+func (i *IndexNode) finishIndexTask(ctx context.Context, ClusterID string, buildID UniqueID, result IndexResult) error {
+	key := taskKey{ClusterID: ClusterID, BuildID: buildID}
+	var evicted []*taskInfo
+	defer func() {
+		if len(evicted) > 0 {
+			i.cleanupDeletedTasks(ctx, evicted)
+		}
+	}()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	info, ok := i.tasks[key]
+	if !ok {
+		return nil
+	}
+	if isTerminalState(info.state) {
+		// the late result of a task failed or cancelled meanwhile is dropped, the task keeps its outcome
+		log.Ctx(ctx).Info("IndexNode drop the result of terminal task", zap.String("clusterID", key.ClusterID),
+			zap.Int64("buildID", key.BuildID), zap.String("state", info.state.String()))
+		return nil
+	}
+	var err error
+	if evicted, err = i.accountClusterSerializedSize(ctx, key, info, result.SerializedSize); err != nil {
+		return err
+	}
+	storeTaskFileKeys(info, result.CurrentIndexVersion, newTaskFileKeys(key, result.FileKeys))
+	info.serializedSize = result.SerializedSize
+	i.storeStatistic(key, info, result.Statistic)
+	info.currentIndexVersion = result.CurrentIndexVersion
+	info.indexStoreVersion = result.IndexStoreVersion
+	// the task finishing without index files may be failed instead, evicting the failed tasks beyond the retention
+	evicted = i.setTaskStateLocked(ctx, key, info, commonpb.IndexState_Finished, "")
+	return nil
+}
+
+// cloneJobInfo is a seam for tests to inject an unexpected clone result.
+var cloneJobInfo = proto.Clone
+
+// cloneStatistic returns a copy of the statistic of the task, ok is false if it can't be copied.
+func cloneStatistic(key taskKey, statistic *indexpb.JobInfo) (*indexpb.JobInfo, bool) {
+	if statistic == nil {
+		return nil, true
+	}
+	cloned, ok := cloneJobInfo(statistic).(*indexpb.JobInfo)
+	if !ok {
+		log.Error("IndexNode failed to clone statistic of task",
+			zap.String("clusterID", key.ClusterID), zap.Int64("buildID", key.BuildID))
+		return nil, false
+	}
+	return cloned, true
+}
+
+// storeStatistic stores a copy of statistic into the task, the statistic is skipped if it can't be copied.
+// stateLock must be held by the caller.
+func (i *IndexNode) storeStatistic(key taskKey, info *taskInfo, statistic *indexpb.JobInfo) {
+	if cloned, ok := cloneStatistic(key, statistic); ok {
+		info.statistic = cloned
+	}
+}
+
+// jobStatNames are the job_stat metric labels reported by jobInfoToMetrics.
+var jobStatNames = []string{"num_rows", "dim", "build_seconds"}
+
+// jobInfoToMetrics flattens the numeric fields of the statistic, keyed by the job_stat metric label.
+// New fields of JobInfo are surfaced by adding them here and to jobStatNames.
+func jobInfoToMetrics(statistic *indexpb.JobInfo) map[string]float64 {
+	stats := map[string]float64{
+		"num_rows": float64(statistic.GetNumRows()),
+		"dim":      float64(statistic.GetDim()),
+	}
+	if statistic.GetStartTime() > 0 && statistic.GetEndTime() >= statistic.GetStartTime() {
+		stats["build_seconds"] = (time.Duration(statistic.GetEndTime()-statistic.GetStartTime()) * time.Microsecond).Seconds()
+	}
+	return stats
+}
+
+// clusterJobStats sums up the statistics of the tasks of the cluster, the tasks without statistic are skipped.
+func (i *IndexNode) clusterJobStats(clusterID string) *indexpb.JobStats {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	stats := &indexpb.JobStats{ClusterID: clusterID}
+	for key, info := range i.tasks {
+		if key.ClusterID != clusterID || info.statistic == nil {
+			continue
+		}
+		stats.TaskNum++
+		stats.NumRows += info.statistic.GetNumRows()
+		if info.statistic.GetStartTime() > 0 && info.statistic.GetEndTime() >= info.statistic.GetStartTime() {
+			stats.BuildTime += info.statistic.GetEndTime() - info.statistic.GetStartTime()
+		}
+	}
+	return stats
+}
+
+func observeFinishedTaskStats(key taskKey, statistic *indexpb.JobInfo) {
+	if statistic == nil {
+		return
+	}
+	nodeID := strconv.FormatInt(paramtable.GetNodeID(), 10)
+	for name, value := range jobInfoToMetrics(statistic) {
+		metrics.IndexNodeFinishedTaskStats.WithLabelValues(nodeID, key.ClusterID, name).Set(value)
+	}
+}
+
+// accountClusterSerializedSize replaces the serialized size of the task in the total of its cluster.
+// If the size exceeds MaxSerializedSizePerTask, or the total would exceed MaxClusterSerializedSize,
+// the task is marked failed and an error is returned, along with the failed tasks evicted to make room for it,
+// which should be cleaned up after stateLock is released. stateLock must be held by the caller.
+func (i *IndexNode) accountClusterSerializedSize(ctx context.Context, key taskKey, info *taskInfo, serializedSize uint64) ([]*taskInfo, error) {
+	var err error
+	total := i.clusterSerializedSizes[key.ClusterID] - info.serializedSize + serializedSize
+	maxTaskSize := Params.IndexNodeCfg.MaxSerializedSizePerTask.GetAsUint64()
+	maxSize := Params.IndexNodeCfg.MaxClusterSerializedSize.GetAsUint64()
+	if maxTaskSize > 0 && serializedSize > maxTaskSize {
+		err = merr.WrapErrServiceQuotaExceeded("index too large",
+			fmt.Sprintf("buildID=%d, serializedSize=%d, maxSerializedSizePerTask=%d", key.BuildID, serializedSize, maxTaskSize))
+	} else if maxSize > 0 && total > maxSize {
+		err = merr.WrapErrServiceQuotaExceeded("cluster index quota exceeded",
+			fmt.Sprintf("clusterID=%s, serializedSize=%d, maxClusterSerializedSize=%d", key.ClusterID, total, maxSize))
+	}
+	if err != nil {
+		log.Ctx(ctx).Warn("IndexNode reject index files of task", zap.String("clusterID", key.ClusterID),
+			zap.Int64("buildID", key.BuildID), zap.Error(err))
+		return i.setTaskStateLocked(ctx, key, info, commonpb.IndexState_Failed, err.Error()), err
+	}
+	i.clusterSerializedSizes[key.ClusterID] = total
+	return nil, nil
+}
+
+// trackedStorageFootprint returns the number of index files of all the index versions tracked by the index node,
+// and their total serialized size.
+func (i *IndexNode) trackedStorageFootprint() (objects int, bytes uint64) {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	for _, info := range i.tasks {
+		for _, fileKeys := range taskFileKeysByVersion(info) {
+			objects += fileKeys.len()
+		}
+		bytes += info.serializedSize
+	}
+	return objects, bytes
+}
+
+// the approximate overhead of a map entry besides its key and value
+const mapEntryOverhead = 16
+
+// estimateTaskMapMemory approximates the bytes of heap held by the task bookkeeping, counting the entries of
+// the task maps, the tasks with their strings, file keys and statistics. It's a rough estimate, as neither
+// the slack of the map buckets nor the memory shared between the tasks is taken into account.
+func (i *IndexNode) estimateTaskMapMemory() uint64 {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	var (
+		pointerSize = uint64(unsafe.Sizeof(&taskInfo{}))
+		keySize     = uint64(unsafe.Sizeof(taskKey{}))
+		infoSize    = uint64(unsafe.Sizeof(taskInfo{}))
+	)
+	size := uint64(0)
+	for key, info := range i.tasks {
+		size += mapEntryOverhead + keySize + uint64(len(key.ClusterID)) + pointerSize + infoSize
+		size += uint64(len(info.failReason) + len(info.cancelReason) + len(info.workerID))
+		size += info.fileKeys.memSize()
+		for _, fileKeys := range info.versionFileKeys {
+			size += mapEntryOverhead + uint64(unsafe.Sizeof(fileKeys)) + fileKeys.memSize()
+		}
+		size += uint64(cap(info.segmentIDs)) * uint64(unsafe.Sizeof(int64(0)))
+		for k, v := range info.diagnostics {
+			size += mapEntryOverhead + 2*uint64(unsafe.Sizeof("")) + uint64(len(k)+len(v))
+		}
+		if info.statistic != nil {
+			size += uint64(proto.Size(info.statistic))
+		}
+	}
+	// the cluster IDs of the indexes are shared with the task keys
+	size += uint64(len(i.buildClusters)) * (mapEntryOverhead + uint64(unsafe.Sizeof(UniqueID(0))+unsafe.Sizeof("")))
+	size += uint64(len(i.segmentTasks)) * (mapEntryOverhead + uint64(unsafe.Sizeof(int64(0))) + keySize)
+	return size
+}
+
+// untrackClusterSerializedSize removes the serialized size of a deleted task from the total of its cluster.
+// stateLock must be held by the caller.
+func (i *IndexNode) untrackClusterSerializedSize(key taskKey, info *taskInfo) {
+	total := i.clusterSerializedSizes[key.ClusterID] - info.serializedSize
+	if total == 0 {
+		delete(i.clusterSerializedSizes, key.ClusterID)
+		return
+	}
+	i.clusterSerializedSizes[key.ClusterID] = total
+}
+
+// clusterSerializedSize returns the total serialized size of the index files tracked for the cluster.
+func (i *IndexNode) clusterSerializedSize(clusterID string) uint64 {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	return i.clusterSerializedSizes[clusterID]
 }
 
 func (i *IndexNode) deleteTaskInfos(ctx context.Context, keys []taskKey) []*taskInfo {
@@ -103,21 +918,126 @@ func (i *IndexNode) deleteTaskInfos(ctx context.Context, keys []taskKey) []*task
 	defer i.stateLock.Unlock()
 	deleted := make([]*taskInfo, 0, len(keys))
 	for _, key := range keys {
-		info, ok := i.tasks[key]
-		if ok {
+		if info, ok := i.deleteTaskLocked(ctx, key); ok {
 			deleted = append(deleted, info)
-			delete(i.tasks, key)
-			log.Ctx(ctx).Info("delete task infos",
-				zap.String("cluster_id", key.ClusterID), zap.Int64("build_id", key.BuildID))
 		}
 	}
 	return deleted
 }
 
-func (i *IndexNode) deleteAllTasks() []*taskInfo {
+// deleteTaskLocked removes the task and the indexes referring to it, stateLock must be held by the caller.
+func (i *IndexNode) deleteTaskLocked(ctx context.Context, key taskKey) (*taskInfo, bool) {
+	info, ok := i.tasks[key]
+	if !ok {
+		return nil, false
+	}
+	delete(i.tasks, key)
+	i.untrackClusterTask(key)
+	notifyTaskWaiters(info)
+	info.cleanedUp = make(chan struct{})
+	i.deletingTasks[key] = info
+	i.tombstones.add(key, i.clock.Now(), finishedIndexVersion(info), Params.IndexNodeCfg.TaskTombstoneCapacity.GetAsInt())
+	if i.buildClusters[key.BuildID] == key.ClusterID {
+		delete(i.buildClusters, key.BuildID)
+	}
+	i.untrackClusterSerializedSize(key, info)
+	i.untrackTaskSegments(key, info)
+	if i.latestFinished[key.ClusterID] == key {
+		delete(i.latestFinished, key.ClusterID)
+	}
+	if info.state == commonpb.IndexState_Failed {
+		i.forgetFailedTask(key)
+	}
+	log.Ctx(ctx).Info("delete task infos",
+		zap.String("cluster_id", key.ClusterID), zap.Int64("build_id", key.BuildID))
+	return info, true
+}
+
+// retainFailedTask records the newly failed task, and deletes the oldest failed tasks of the cluster
+// beyond MaxRetainedFailedTasksPerCluster. stateLock must be held by the caller.
+func (i *IndexNode) retainFailedTask(ctx context.Context, key taskKey) []*taskInfo {
+	i.clusterFailedTasks[key.ClusterID] = append(i.clusterFailedTasks[key.ClusterID], key)
+	maxRetained := Params.IndexNodeCfg.MaxRetainedFailedTasksPerCluster.GetAsInt()
+	if maxRetained <= 0 {
+		return nil
+	}
+	var evicted []*taskInfo
+	for len(i.clusterFailedTasks[key.ClusterID]) > maxRetained {
+		oldest := i.clusterFailedTasks[key.ClusterID][0]
+		i.forgetFailedTask(oldest)
+		info, ok := i.deleteTaskLocked(ctx, oldest)
+		if !ok {
+			continue
+		}
+		log.Ctx(ctx).Info("IndexNode evict the oldest failed task", zap.String("clusterID", oldest.ClusterID),
+			zap.Int64("buildID", oldest.BuildID), zap.Int("maxRetained", maxRetained))
+		evicted = append(evicted, info)
+	}
+	return evicted
+}
+
+// forgetFailedTask removes the task from the retained failed tasks of its cluster.
+// stateLock must be held by the caller.
+func (i *IndexNode) forgetFailedTask(key taskKey) {
+	failed := i.clusterFailedTasks[key.ClusterID]
+	for idx, failedKey := range failed {
+		if failedKey == key {
+			failed = append(failed[:idx], failed[idx+1:]...)
+			break
+		}
+	}
+	if len(failed) == 0 {
+		delete(i.clusterFailedTasks, key.ClusterID)
+		return
+	}
+	i.clusterFailedTasks[key.ClusterID] = failed
+}
+
+// retainedFailedTasks returns the number of failed tasks retained for the cluster.
+func (i *IndexNode) retainedFailedTasks(clusterID string) int {
 	i.stateLock.Lock()
-	deletedTasks := i.tasks
+	defer i.stateLock.Unlock()
+	return len(i.clusterFailedTasks[clusterID])
+}
+
+// resetTasks swaps out the task map together with all the bookkeeping derived from it,
+// so that they never drift apart. Any new derived state must be reset here as well.
+// stateLock must be held by the caller.
+func (i *IndexNode) resetTasks() map[taskKey]*taskInfo {
+	for clusterID := range i.clusterTaskCounts {
+		deleteClusterMetrics(clusterID)
+	}
+	tasks := i.tasks
 	i.tasks = make(map[taskKey]*taskInfo)
+	i.buildClusters = make(map[UniqueID]string)
+	i.clusterSerializedSizes = make(map[string]uint64)
+	i.latestFinished = make(map[string]taskKey)
+	i.clusterFailedTasks = make(map[string][]taskKey)
+	i.segmentTasks = make(map[int64]taskKey)
+	i.clusterTaskCounts = make(map[string]int)
+	i.lastClusterErrors = make(map[string]ClusterError)
+	i.terminalTaskCounts = make(map[string]*terminalTaskCount)
+	i.recentOutcomes = make(map[string]*taskOutcomes)
+	i.stateLogLimiters = make(map[string]*stateLogLimiter)
+	return tasks
+}
+
+// deleteAllTasks deletes all the tasks on shutdown, the tasks not reaching a terminal state yet
+// are marked cancelled by the shutdown, they are cancelled by cleanupDeletedTasks then.
+func (i *IndexNode) deleteAllTasks() []*taskInfo {
+	i.stateLock.Lock()
+	deletedTasks := i.resetTasks()
+	now := i.clock.Now()
+	capacity := Params.IndexNodeCfg.TaskTombstoneCapacity.GetAsInt()
+	for key, info := range deletedTasks {
+		i.tombstones.add(key, now, finishedIndexVersion(info), capacity)
+		notifyTaskWaiters(info)
+		if !isTerminalState(info.state) && !info.cancelled && !info.uncancellable {
+			info.cancelled = true
+			info.cancelReason = "node shutdown"
+			info.version++
+		}
+	}
 	i.stateLock.Unlock()
 
 	deleted := make([]*taskInfo, 0, len(deletedTasks))
@@ -127,42 +1047,452 @@ func (i *IndexNode) deleteAllTasks() []*taskInfo {
 	return deleted
 }
 
+// throughputSince returns the serialized bytes per second produced by the tasks finished after start.
+func (i *IndexNode) throughputSince(start time.Time) float64 {
+	window := i.clock.Since(start).Seconds()
+	if window <= 0 {
+		return 0
+	}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	var bytes uint64
+	for _, info := range i.tasks {
+		if info.state == commonpb.IndexState_Finished && info.endTime.After(start) {
+			bytes += info.serializedSize
+		}
+	}
+	return float64(bytes) / window
+}
+
+// taskAgeDistribution returns the number of tasks per age bucket, the age of a task counts from registration.
+func (i *IndexNode) taskAgeDistribution() map[string]int {
+	now := i.clock.Now()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	distribution := map[string]int{
+		"<1m":    0,
+		"1m-10m": 0,
+		"10m-1h": 0,
+		">1h":    0,
+	}
+	for _, info := range i.tasks {
+		age := now.Sub(info.createTime)
+		switch {
+		case age < time.Minute:
+			distribution["<1m"]++
+		case age < 10*time.Minute:
+			distribution["1m-10m"]++
+		case age < time.Hour:
+			distribution["10m-1h"]++
+		default:
+			distribution[">1h"]++
+		}
+	}
+	return distribution
+}
+
+// oldestQueuedAgePerCluster returns the age of the oldest queued task of each cluster, the clusters without
+// queued tasks are absent. The reconciled placeholders are not taken as queued, as there is no job behind them.
+func (i *IndexNode) oldestQueuedAgePerCluster() map[string]time.Duration {
+	now := i.clock.Now()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	ages := make(map[string]time.Duration)
+	for key, info := range i.tasks {
+		if info.state != commonpb.IndexState_Unissued || info.reconciled {
+			continue
+		}
+		if age := now.Sub(info.createTime); age >= ages[key.ClusterID] {
+			ages[key.ClusterID] = age
+		}
+	}
+	return ages
+}
+
 func (i *IndexNode) hasInProgressTask() bool {
 	i.stateLock.Lock()
 	defer i.stateLock.Unlock()
 	for _, info := range i.tasks {
-		if info.state == commonpb.IndexState_InProgress {
+		if isPendingTask(info) {
 			return true
 		}
 	}
 	return false
 }
 
-func (i *IndexNode) waitTaskFinish() {
-	if !i.hasInProgressTask() {
-		return
+// isPendingTask returns whether the task is queued or running, the reconciled placeholders are excluded
+// as there is no job behind them.
+func isPendingTask(info *taskInfo) bool {
+	return info.state == commonpb.IndexState_InProgress ||
+		(info.state == commonpb.IndexState_Unissued && !info.reconciled)
+}
+
+// isTerminalState returns whether the index node has nothing left to do for a task in this state.
+func isTerminalState(state commonpb.IndexState) bool {
+	return state == commonpb.IndexState_Finished ||
+		state == commonpb.IndexState_Failed ||
+		state == commonpb.IndexState_Retry
+}
+
+func (i *IndexNode) inProgressTaskKeys() []taskKey {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	keys := make([]taskKey, 0)
+	for key, info := range i.tasks {
+		if isPendingTask(info) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// countDrainedTasks counts the tasks in keys which are no longer in progress,
+// either because they reached a terminal state or because they have been dropped.
+func (i *IndexNode) countDrainedTasks(keys []taskKey) int {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	drained := 0
+	for _, key := range keys {
+		if info, ok := i.tasks[key]; !ok || !isPendingTask(info) {
+			drained++
+		}
+	}
+	return drained
+}
+
+// waitTaskFinish waits for the in-progress tasks until they are done or the graceful stop timeout is reached,
+// it returns the number of tasks drained during the waiting.
+func (i *IndexNode) waitTaskFinish() int {
+	inProgressKeys := i.inProgressTaskKeys()
+	if len(inProgressKeys) == 0 {
+		return 0
 	}
 
-	gracefulTimeout := &Params.IndexNodeCfg.GracefulStopTimeout
-	ticker := time.NewTicker(time.Second)
+	gracefulTimeout := Params.IndexNodeCfg.GracefulStopTimeout.GetAsDuration(time.Second)
+	ticker := i.clock.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	timeoutCtx, cancel := context.WithTimeout(i.loopCtx, gracefulTimeout.GetAsDuration(time.Second))
-	defer cancel()
+	start := i.clock.Now()
+	i.stateLock.Lock()
+	i.gracefulStopStart, i.gracefulStopTimeout = start, gracefulTimeout
+	i.stateLock.Unlock()
+	defer func() {
+		i.stateLock.Lock()
+		i.gracefulStopStart, i.gracefulStopTimeout = time.Time{}, 0
+		i.stateLock.Unlock()
+	}()
+
+	deadline := start.Add(gracefulTimeout)
 	for {
+		timeout := false
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			if !i.hasInProgressTask() {
-				return
+				return i.countDrainedTasks(inProgressKeys)
 			}
-		case <-timeoutCtx.Done():
+			timeout = !i.clock.Now().Before(deadline)
+		case <-i.loopCtx.Done():
+			timeout = true
+		}
+		if timeout {
 			log.Warn("timeout, the index node has some progress task")
-			for _, info := range i.tasks {
-				if info.state == commonpb.IndexState_InProgress {
-					log.Warn("progress task", zap.Any("info", info))
+			for _, snapshot := range i.pendingTaskSnapshots() {
+				log.Warn("progress task", zap.String("clusterID", snapshot.ClusterID), zap.Int64("buildID", snapshot.BuildID),
+					zap.String("workerID", snapshot.WorkerID), zap.Any("info", snapshot))
+			}
+			return i.countDrainedTasks(inProgressKeys)
+		}
+	}
+}
+
+// gracefulStopProgress returns how long the graceful stop has waited for the in-progress tasks,
+// and how much of the graceful stop timeout is left, draining is false if it's not waiting.
+func (i *IndexNode) gracefulStopProgress() (elapsed, remaining time.Duration, draining bool) {
+	now := i.clock.Now()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	if i.gracefulStopStart.IsZero() {
+		return 0, 0, false
+	}
+	elapsed = now.Sub(i.gracefulStopStart)
+	if elapsed < i.gracefulStopTimeout {
+		remaining = i.gracefulStopTimeout - elapsed
+	}
+	return elapsed, remaining, true
+}
+
+// cleanupDeletedTasks cancels the deleted tasks and runs their onDelete hooks,
+// the hooks are run concurrently by at most TaskCleanupParallel workers, it returns after all of them are done.
+// The tasks deleted while uncancellable are not cancelled, their builds run to the end.
+func (i *IndexNode) cleanupDeletedTasks(ctx context.Context, infos []*taskInfo) error {
+	parallel := Params.IndexNodeCfg.TaskCleanupParallel.GetAsInt()
+	if parallel < 1 {
+		parallel = 1
+	}
+	pool := conc.NewPool[any](parallel)
+	defer pool.Release()
+
+	defer i.finishTaskCleanup(infos)
+	futures := make([]*conc.Future[any], 0, len(infos))
+	for _, info := range infos {
+		// the deleted tasks are not reachable by setTaskUncancellable anymore, it's safe to read the flag without lock
+		if info.uncancellable {
+			log.Ctx(ctx).Info("IndexNode skip cancelling uncancellable deleted task",
+				zap.String("clusterID", info.key.ClusterID), zap.Int64("buildID", info.key.BuildID))
+		} else if info.cancel != nil {
+			info.cancel()
+		}
+		if info.onDelete != nil {
+			onDelete := info.onDelete
+			futures = append(futures, pool.Submit(func() (any, error) {
+				return nil, onDelete()
+			}))
+		}
+	}
+
+	errs := make([]error, 0)
+	for _, future := range futures {
+		if err := future.Err(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		err := merr.Combine(errs...)
+		log.Ctx(ctx).Warn("failed to cleanup deleted tasks", zap.Int("failed", len(errs)), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// ShutdownReport summarizes how the tasks tracked by the index node were handled when it stopped.
+type ShutdownReport struct {
+	// Drained is the number of in-progress tasks which were done during the graceful stop.
+	Drained int
+	// ForceCancelled is the number of tasks which were still running and got cancelled.
+	ForceCancelled int
+	// AlreadyTerminal is the number of tasks which had already finished, failed or been marked to retry.
+	AlreadyTerminal int
+	// Dropped is the number of tasks which were still running and got dropped without being cancelled.
+	Dropped int
+}
+
+// the policies of ResetInProgressTaskPolicy
+const (
+	resetPolicyCancel = "cancel"
+	resetPolicyWait   = "wait"
+	resetPolicyDrop   = "drop"
+)
+
+// cleanupAllTasks removes all the tasks, waited is whether the caller has run waitTaskFinish,
+// and drained is the number of tasks done by it. The tasks still in progress are handled according to
+// ResetInProgressTaskPolicy, the wait policy doesn't wait again if the caller has waited.
+// ctx is the context of the stopping node, which the cleanup of the tasks is logged with.
+func (i *IndexNode) cleanupAllTasks(ctx context.Context, waited bool, drained int) ShutdownReport {
+	report := ShutdownReport{Drained: drained}
+	policy := Params.IndexNodeCfg.ResetInProgressTaskPolicy.GetValue()
+	switch policy {
+	case resetPolicyCancel, resetPolicyDrop:
+	case resetPolicyWait:
+		if !waited {
+			report.Drained += i.waitTaskFinish()
+		}
+	default:
+		log.Ctx(ctx).Warn("unknown reset policy of in-progress tasks, cancel them", zap.String("policy", policy))
+		policy = resetPolicyCancel
+	}
+
+	deletedTasks := i.deleteAllTasks()
+	cleanupTasks := make([]*taskInfo, 0, len(deletedTasks))
+	for _, task := range deletedTasks {
+		if isTerminalState(task.state) {
+			report.AlreadyTerminal++
+		} else if policy == resetPolicyDrop {
+			report.Dropped++
+			continue
+		} else if task.uncancellable {
+			// left running by cleanupDeletedTasks
+			report.Dropped++
+		} else {
+			report.ForceCancelled++
+		}
+		cleanupTasks = append(cleanupTasks, task)
+	}
+	i.cleanupDeletedTasks(ctx, cleanupTasks)
+
+	i.stateLock.Lock()
+	i.shutdownReport = report
+	i.stateLock.Unlock()
+	log.Ctx(ctx).Info("index node shutdown report",
+		zap.String("policy", policy),
+		zap.Int("drained", report.Drained),
+		zap.Int("forceCancelled", report.ForceCancelled),
+		zap.Int("alreadyTerminal", report.AlreadyTerminal),
+		zap.Int("dropped", report.Dropped))
+	return report
+}
+
+// GetShutdownReport returns the report of the last stop, it's empty if the node has not been stopped.
+func (i *IndexNode) GetShutdownReport() ShutdownReport {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	return i.shutdownReport
+}
+
+// DumpTasksProto marshals a snapshot of the tasks tracked by the index node into protobuf, ordered by cluster
+// and build ID. The tasks are copied with one lock acquisition, and sorted and marshaled after the lock is released.
+// All the file keys are dumped, as the dump is imported by the successor process on handoff.
+func (i *IndexNode) DumpTasksProto() ([]byte, error) {
+	dump := &indexpb.IndexNodeTaskDump{}
+	i.foreachTaskInfo(func(ClusterID string, buildID UniqueID, info *taskInfo) {
+		statistic, _ := cloneStatistic(taskKey{ClusterID: ClusterID, BuildID: buildID}, info.statistic)
+		dump.IndexTasks = append(dump.IndexTasks, &indexpb.IndexNodeTaskSnapshot{
+			ClusterID: ClusterID,
+			Info: &indexpb.IndexTaskInfo{
+				BuildID:             buildID,
+				State:               info.state,
+				IndexFileKeys:       info.fileKeys.keys(),
+				SerializedSize:      info.serializedSize,
+				FailReason:          info.failReason,
+				CurrentIndexVersion: info.currentIndexVersion,
+				IndexStoreVersion:   info.indexStoreVersion,
+			},
+			Statistic:       statistic,
+			CreateTime:      toUnixMicro(info.createTime),
+			StartTime:       toUnixMicro(info.startTime),
+			EndTime:         toUnixMicro(info.endTime),
+			VersionFileKeys: versionFileKeysToProto(info.versionFileKeys),
+			Cancelled:       info.cancelled,
+			CancelReason:    info.cancelReason,
+			SegmentIDs:      slices.Clone(info.segmentIDs),
+			WorkerID:        info.workerID,
+			IsRebuild:       info.isRebuild,
+			Diagnostics:     maps.Clone(info.diagnostics),
+		})
+	})
+	sort.Slice(dump.IndexTasks, func(x, y int) bool {
+		return lessTaskKey(
+			taskKey{ClusterID: dump.IndexTasks[x].GetClusterID(), BuildID: dump.IndexTasks[x].GetInfo().GetBuildID()},
+			taskKey{ClusterID: dump.IndexTasks[y].GetClusterID(), BuildID: dump.IndexTasks[y].GetInfo().GetBuildID()})
+	})
+	return proto.Marshal(dump)
+}
+
+// tasksWithFilePrefix returns the keys of the tasks which have any file key of any index version starting with prefix.
+func (i *IndexNode) tasksWithFilePrefix(prefix string) []taskKey {
+	keys := make([]taskKey, 0)
+	i.foreachTaskInfo(func(ClusterID string, buildID UniqueID, info *taskInfo) {
+		for _, fileKeys := range taskFileKeysByVersion(info) {
+			for _, fileKey := range fileKeys.keys() {
+				if strings.HasPrefix(fileKey, prefix) {
+					keys = append(keys, taskKey{ClusterID: ClusterID, BuildID: buildID})
+					return
 				}
 			}
-			return
+		}
+	})
+	return keys
+}
+
+// countIndexTasks returns the number of tasks matching pred.
+// pred is evaluated with stateLock held, so it must not call any method of the index node which takes the lock.
+func (i *IndexNode) countIndexTasks(pred func(*taskInfo) bool) int {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	count := 0
+	for _, info := range i.tasks {
+		if pred(info) {
+			count++
+		}
+	}
+	return count
+}
+
+// deleteTasksWhere deletes the tasks matching pred, cancels them and runs their onDelete hooks,
+// and returns the deleted tasks. pred is evaluated with stateLock held,
+// so it must not call any method of the index node which takes the lock.
+func (i *IndexNode) deleteTasksWhere(ctx context.Context, pred func(*taskInfo) bool) []*taskInfo {
+	i.stateLock.Lock()
+	keys := make([]taskKey, 0)
+	for key, info := range i.tasks {
+		if pred(info) {
+			keys = append(keys, key)
+		}
+	}
+	deleted := make([]*taskInfo, 0, len(keys))
+	for _, key := range keys {
+		if info, ok := i.deleteTaskLocked(ctx, key); ok {
+			deleted = append(deleted, info)
+		}
+	}
+	i.stateLock.Unlock()
+
+	i.cleanupDeletedTasks(ctx, deleted)
+	return deleted
+}
+
+// purgeFinishedForCluster deletes the terminal tasks of the cluster under one lock acquisition,
+// and returns the number of deleted tasks. The queued and running tasks of the cluster are kept.
+func (i *IndexNode) purgeFinishedForCluster(clusterID string) int {
+	ctx := context.Background()
+	i.stateLock.Lock()
+	deleted := make([]*taskInfo, 0)
+	for key, info := range i.tasks {
+		if key.ClusterID != clusterID || !isTerminalState(info.state) {
+			continue
+		}
+		if _, ok := i.deleteTaskLocked(ctx, key); ok {
+			deleted = append(deleted, info)
+		}
+	}
+	i.stateLock.Unlock()
+
+	i.cleanupDeletedTasks(ctx, deleted)
+	log.Info("IndexNode purge the terminal tasks of cluster", zap.String("clusterID", clusterID), zap.Int("deleted", len(deleted)))
+	return len(deleted)
+}
+
+// ReapResult reports the tasks handled by reapTasksOlderThan.
+type ReapResult struct {
+	Cancelled int
+	Deleted   int
+}
+
+// reapTasksOlderThan cancels the tasks running longer than maxAge, and deletes the terminal tasks
+// which reached the terminal state more than maxAge ago, under one lock acquisition.
+func (i *IndexNode) reapTasksOlderThan(ctx context.Context, maxAge time.Duration) ReapResult {
+	result := ReapResult{}
+	now := i.clock.Now()
+	i.stateLock.Lock()
+	expired := make([]taskKey, 0)
+	for key, info := range i.tasks {
+		switch {
+		case info.state == commonpb.IndexState_InProgress && !info.cancelled:
+			since := info.startTime
+			if since.IsZero() {
+				since = info.createTime
+			}
+			if now.Sub(since) > maxAge && cancelTaskLocked(key, info, fmt.Sprintf("running longer than %s", maxAge)) {
+				result.Cancelled++
+			}
+		case isTerminalState(info.state):
+			since := info.endTime
+			if since.IsZero() {
+				since = info.createTime
+			}
+			if now.Sub(since) > maxAge {
+				expired = append(expired, key)
+			}
 		}
 	}
+	deleted := make([]*taskInfo, 0, len(expired))
+	for _, key := range expired {
+		if info, ok := i.deleteTaskLocked(ctx, key); ok {
+			deleted = append(deleted, info)
+		}
+	}
+	i.stateLock.Unlock()
+
+	i.cleanupDeletedTasks(ctx, deleted)
+	result.Deleted = len(deleted)
+	return result
 }
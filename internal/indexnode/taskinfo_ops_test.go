@@ -0,0 +1,2987 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+	"golang.org/x/exp/maps"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/internal/proto/indexpb"
+	"github.com/milvus-io/milvus/pkg/metrics"
+	"github.com/milvus-io/milvus/pkg/util/merr"
+	"github.com/milvus-io/milvus/pkg/util/paramtable"
+)
+
+func newTestIndexNode() *IndexNode {
+	paramtable.Init()
+	return NewIndexNode(context.TODO(), &mockFactory{
+		chunkMgr: &mockChunkmgr{},
+	})
+}
+
+func TestIndexNode_waitTaskFinishDrained(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Equal(t, 0, in.waitTaskFinish())
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Finished})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	}()
+	assert.Equal(t, 1, in.waitTaskFinish())
+}
+
+func TestIndexNode_cleanupAllTasks(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Equal(t, ShutdownReport{}, in.GetShutdownReport())
+
+	cancelled := 0
+	cancel := func() { cancelled++ }
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Finished, cancel: cancel})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_Retry})
+
+	report := in.cleanupAllTasks(context.TODO(), true, 2)
+	assert.Equal(t, ShutdownReport{Drained: 2, ForceCancelled: 1, AlreadyTerminal: 2}, report)
+	assert.Equal(t, report, in.GetShutdownReport())
+	assert.Equal(t, 2, cancelled)
+	assert.Empty(t, in.deleteAllTasks())
+}
+
+func TestIndexNode_cleanupAllTasksPolicy(t *testing.T) {
+	paramtable.Init()
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.ResetInProgressTaskPolicy.Key)
+	setup := func() (*IndexNode, *int) {
+		in := newTestIndexNode()
+		cancelled := 0
+		cancel := func() { cancelled++ }
+		in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+		in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Finished, cancel: cancel})
+		return in, &cancelled
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		paramtable.Get().Save(Params.IndexNodeCfg.ResetInProgressTaskPolicy.Key, "cancel")
+		in, cancelled := setup()
+		report := in.cleanupAllTasks(context.TODO(), false, 0)
+		assert.Equal(t, ShutdownReport{ForceCancelled: 1, AlreadyTerminal: 1}, report)
+		assert.Equal(t, 2, *cancelled)
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		paramtable.Get().Save(Params.IndexNodeCfg.ResetInProgressTaskPolicy.Key, "unknown")
+		in, cancelled := setup()
+		report := in.cleanupAllTasks(context.TODO(), false, 0)
+		assert.Equal(t, ShutdownReport{ForceCancelled: 1, AlreadyTerminal: 1}, report)
+		assert.Equal(t, 2, *cancelled)
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		paramtable.Get().Save(Params.IndexNodeCfg.ResetInProgressTaskPolicy.Key, "wait")
+		in, cancelled := setup()
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+		}()
+		report := in.cleanupAllTasks(context.TODO(), false, 0)
+		assert.Equal(t, ShutdownReport{Drained: 1, AlreadyTerminal: 2}, report)
+		assert.Equal(t, 2, *cancelled)
+	})
+
+	t.Run("wait after the caller waited", func(t *testing.T) {
+		paramtable.Get().Save(Params.IndexNodeCfg.ResetInProgressTaskPolicy.Key, "wait")
+		in, cancelled := setup()
+		clock := newFakeClock()
+		in.clock = clock
+		// not waiting again, the running task is cancelled
+		report := in.cleanupAllTasks(context.TODO(), true, 0)
+		assert.Equal(t, ShutdownReport{ForceCancelled: 1, AlreadyTerminal: 1}, report)
+		assert.Equal(t, 0, clock.numTickers())
+		assert.Equal(t, 2, *cancelled)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		paramtable.Get().Save(Params.IndexNodeCfg.ResetInProgressTaskPolicy.Key, "drop")
+		in, cancelled := setup()
+		report := in.cleanupAllTasks(context.TODO(), false, 0)
+		assert.Equal(t, ShutdownReport{AlreadyTerminal: 1, Dropped: 1}, report)
+		// only the terminal task is cleaned up
+		assert.Equal(t, 1, *cancelled)
+		assert.Empty(t, in.deleteAllTasks())
+	})
+}
+
+func TestIndexNode_deleteAllTasksCancelReason(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_Finished})
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.True(t, in.cancelTask("cluster-1", 4, "dropped"))
+
+	reasons := map[commonpb.IndexState][]string{}
+	for _, info := range in.deleteAllTasks() {
+		reasons[info.state] = append(reasons[info.state], info.cancelReason)
+	}
+	assert.ElementsMatch(t, []string{"node shutdown", "dropped"}, reasons[commonpb.IndexState_InProgress])
+	assert.Equal(t, []string{"node shutdown"}, reasons[commonpb.IndexState_Unissued])
+	assert.Equal(t, []string{""}, reasons[commonpb.IndexState_Finished])
+}
+
+func TestIndexNode_clusterSerializedSizeQuota(t *testing.T) {
+	in := newTestIndexNode()
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxClusterSerializedSize.Key, "100")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.MaxClusterSerializedSize.Key)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	err := in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file1"}, 60, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+	// reaching the quota exactly is allowed
+	err = in.storeIndexFilesAndStatisticV2("cluster-1", 2, []string{"file2"}, 40, &indexpb.JobInfo{}, 1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), in.clusterSerializedSize("cluster-1"))
+
+	// the failure goes through the state transition, so the waiters are woken up
+	waited := make(chan commonpb.IndexState)
+	go func() {
+		state, _ := in.waitForTaskTerminal(context.TODO(), "cluster-1", 3)
+		waited <- state
+	}()
+	err = in.storeIndexFilesAndStatistic("cluster-1", 3, []string{"file3"}, 1, &indexpb.JobInfo{}, 1)
+	assert.ErrorIs(t, err, merr.ErrServiceQuotaExceeded)
+	assert.Equal(t, commonpb.IndexState_Failed, <-waited)
+	assert.Equal(t, commonpb.IndexState_Failed, in.loadTaskState("cluster-1", 3))
+	assert.False(t, in.indexTaskSnapshots()[2].EndTime.IsZero())
+	assert.Equal(t, UniqueID(3), in.lastErrorPerCluster()["cluster-1"].BuildID)
+	assert.Equal(t, 1, in.retainedFailedTasks("cluster-1"))
+	assert.Equal(t, uint64(100), in.clusterSerializedSize("cluster-1"))
+
+	// other clusters are not affected
+	err = in.storeIndexFilesAndStatistic("cluster-2", 1, []string{"file1"}, 100, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+
+	// storing the same task again replaces its size
+	err = in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file1"}, 50, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(90), in.clusterSerializedSize("cluster-1"))
+
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 2}})
+	assert.Equal(t, uint64(50), in.clusterSerializedSize("cluster-1"))
+	err = in.storeIndexFilesAndStatistic("cluster-1", 3, []string{"file3"}, 50, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, in.checkInvariants())
+
+	in.deleteAllTasks()
+	assert.Equal(t, uint64(0), in.clusterSerializedSize("cluster-1"))
+	assert.Equal(t, uint64(0), in.clusterSerializedSize("cluster-2"))
+}
+
+func TestIndexNode_maxSerializedSizePerTask(t *testing.T) {
+	in := newTestIndexNode()
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxSerializedSizePerTask.Key, "100")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.MaxSerializedSizePerTask.Key)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	// reaching the limit exactly is allowed
+	err := in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file1"}, 100, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+
+	err = in.finishIndexTask(context.TODO(), "cluster-1", 2, IndexResult{FileKeys: []string{"file2"}, SerializedSize: 101})
+	assert.ErrorIs(t, err, merr.ErrServiceQuotaExceeded)
+	snapshot := in.indexTaskSnapshots()[1]
+	assert.Equal(t, commonpb.IndexState_Failed, snapshot.State)
+	assert.Contains(t, snapshot.FailReason, "index too large")
+	assert.Empty(t, snapshot.FileKeys)
+	assert.Equal(t, uint64(100), in.clusterSerializedSize("cluster-1"))
+
+	// the failure evicts the failed tasks beyond the retention, and cleans them up
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxRetainedFailedTasksPerCluster.Key, "1")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.MaxRetainedFailedTasksPerCluster.Key)
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+	err = in.storeIndexFilesAndStatistic("cluster-1", 4, []string{"file4"}, 101, &indexpb.JobInfo{}, 1)
+	assert.ErrorIs(t, err, merr.ErrServiceQuotaExceeded)
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 2))
+	assert.Equal(t, 1, in.retainedFailedTasks("cluster-1"))
+	assert.Empty(t, in.deletingTasks)
+
+	// 0 means unlimited
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxSerializedSizePerTask.Key, "0")
+	err = in.storeIndexFilesAndStatistic("cluster-1", 3, []string{"file3"}, 1000, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1100), in.clusterSerializedSize("cluster-1"))
+}
+
+func TestIndexNode_inconsistentVersionTasks(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Len(t, in.inconsistentVersionTasks(), 0)
+
+	// consistent tasks
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.storeIndexFilesAndStatistic("cluster-1", 2, []string{"file1"}, 10, nil, 1)
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.storeIndexFilesAndStatisticV2("cluster-1", 3, []string{"file1"}, 10, nil, 1, 1)
+	in.storeIndexFilesAndStatisticV2("cluster-1", 3, []string{"file2"}, 10, nil, 2, 1)
+	// inconsistent tasks
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_InProgress, indexStoreVersion: 1})
+	in.loadOrStoreTask("cluster-2", 5, &taskInfo{state: commonpb.IndexState_InProgress, currentIndexVersion: -1})
+	in.loadOrStoreTask("cluster-2", 6, &taskInfo{
+		state:               commonpb.IndexState_InProgress,
+		currentIndexVersion: 1,
+		versionFileKeys:     map[int32]indexFileKeys{1: newIndexFileKeys([]string{"file1"})},
+	})
+
+	assert.Equal(t, []taskKey{
+		{ClusterID: "cluster-2", BuildID: 4},
+		{ClusterID: "cluster-2", BuildID: 5},
+		{ClusterID: "cluster-2", BuildID: 6},
+	}, in.inconsistentVersionTasks())
+}
+
+func TestIndexNode_estimateTaskMapMemory(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Equal(t, uint64(0), in.estimateTaskMapMemory())
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	oneTask := in.estimateTaskMapMemory()
+	assert.Greater(t, oneTask, uint64(0))
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	twoTasks := in.estimateTaskMapMemory()
+	assert.Greater(t, twoTasks, oneTask)
+
+	// the estimate grows with the file keys, fail reasons and statistics of the tasks
+	in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"files/1/a", "files/1/b"}, 100, &indexpb.JobInfo{NumRows: 100}, 1)
+	withFiles := in.estimateTaskMapMemory()
+	assert.Greater(t, withFiles, twoTasks)
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Failed, "build failed")
+	assert.Greater(t, in.estimateTaskMapMemory(), withFiles)
+
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 1}, {ClusterID: "cluster-1", BuildID: 2}})
+	assert.Equal(t, uint64(0), in.estimateTaskMapMemory())
+}
+
+func TestIndexNode_reportTaskActualMem(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Equal(t, uint64(0), in.totalActualMemInProgress())
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	in.reportTaskActualMem("cluster-1", 1, 100)
+	in.reportTaskActualMem("cluster-1", 2, 200)
+	in.reportTaskActualMem("cluster-2", 3, 300)
+	// the report of unknown task is ignored
+	in.reportTaskActualMem("cluster-2", 4, 400)
+	assert.Equal(t, uint64(600), in.totalActualMemInProgress())
+
+	// the last report wins
+	in.reportTaskActualMem("cluster-1", 1, 50)
+	assert.Equal(t, uint64(550), in.totalActualMemInProgress())
+	assert.Equal(t, uint64(50), in.indexTaskSnapshots()[0].ActualMem)
+
+	// the tasks no longer running are not counted
+	in.storeTaskState(context.TODO(), "cluster-2", 3, commonpb.IndexState_Finished, "")
+	assert.Equal(t, uint64(250), in.totalActualMemInProgress())
+}
+
+func TestIndexNode_trackedStorageFootprint(t *testing.T) {
+	in := newTestIndexNode()
+	objects, bytes := in.trackedStorageFootprint()
+	assert.Equal(t, 0, objects)
+	assert.Equal(t, uint64(0), bytes)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	err := in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"files/1/a", "files/1/b"}, 100, &indexpb.JobInfo{}, 4)
+	assert.NoError(t, err)
+	err = in.finishIndexTask(context.TODO(), "cluster-2", 2, IndexResult{FileKeys: []string{"files/2/a", "files/2/b", "files/2/c"}, SerializedSize: 300})
+	assert.NoError(t, err)
+
+	objects, bytes = in.trackedStorageFootprint()
+	assert.Equal(t, 5, objects)
+	assert.Equal(t, uint64(400), bytes)
+}
+
+func TestIndexNode_cancelLongestRunningTask(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	_, ok := in.cancelLongestRunningTask()
+	assert.False(t, ok)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	for buildID := UniqueID(2); buildID <= 4; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_Unissued})
+	}
+	// the task queued the longest is not running
+	clock.Advance(time.Minute)
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_InProgress, "")
+	clock.Advance(time.Minute)
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_InProgress, "")
+	clock.Advance(time.Minute)
+	in.storeTaskState(context.TODO(), "cluster-1", 4, commonpb.IndexState_InProgress, "")
+
+	key, ok := in.cancelLongestRunningTask()
+	assert.True(t, ok)
+	assert.Equal(t, taskKey{ClusterID: "cluster-1", BuildID: 3}, key)
+	key, ok = in.cancelLongestRunningTask()
+	assert.True(t, ok)
+	assert.Equal(t, taskKey{ClusterID: "cluster-1", BuildID: 2}, key)
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Equal(t, "shed for pressure", snapshots[1].CancelReason)
+	assert.Equal(t, "shed for pressure", snapshots[2].CancelReason)
+	assert.False(t, snapshots[0].Cancelled)
+	assert.False(t, snapshots[3].Cancelled)
+}
+
+func TestIndexNode_clusterForBuild(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	clusterID, ok := in.clusterForBuild(1)
+	assert.True(t, ok)
+	assert.Equal(t, "cluster-1", clusterID)
+	_, ok = in.clusterForBuild(3)
+	assert.False(t, ok)
+
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 1}})
+	_, ok = in.clusterForBuild(1)
+	assert.False(t, ok)
+
+	t.Run("collision", func(t *testing.T) {
+		in.loadOrStoreTask("cluster-2", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+		clusterID, ok := in.clusterForBuild(2)
+		assert.True(t, ok)
+		assert.Equal(t, "cluster-2", clusterID)
+
+		// deleting the overridden task keeps the last writer
+		in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 2}})
+		clusterID, ok = in.clusterForBuild(2)
+		assert.True(t, ok)
+		assert.Equal(t, "cluster-2", clusterID)
+
+		in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-2", BuildID: 2}})
+		_, ok = in.clusterForBuild(2)
+		assert.False(t, ok)
+	})
+
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.deleteAllTasks()
+	_, ok = in.clusterForBuild(4)
+	assert.False(t, ok)
+}
+
+func TestIndexNode_DumpTasksProto(t *testing.T) {
+	in := newTestIndexNode()
+	data, err := in.DumpTasksProto()
+	assert.NoError(t, err)
+	dump := &indexpb.IndexNodeTaskDump{}
+	assert.NoError(t, proto.Unmarshal(data, dump))
+	assert.Empty(t, dump.GetIndexTasks())
+
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	err = in.storeIndexFilesAndStatisticV2("cluster-1", 2, []string{"file1", "file2"}, 100,
+		&indexpb.JobInfo{NumRows: 10, Dim: 8}, 1, 2)
+	assert.NoError(t, err)
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Finished, "")
+
+	data, err = in.DumpTasksProto()
+	assert.NoError(t, err)
+	dump = &indexpb.IndexNodeTaskDump{}
+	assert.NoError(t, proto.Unmarshal(data, dump))
+	assert.Len(t, dump.GetIndexTasks(), 2)
+	// the dump is ordered the same as the snapshots
+	for idx, snapshot := range in.indexTaskSnapshots() {
+		assert.Equal(t, snapshot.BuildID, dump.GetIndexTasks()[idx].GetInfo().GetBuildID())
+	}
+	for _, task := range dump.GetIndexTasks() {
+		assert.Equal(t, "cluster-1", task.GetClusterID())
+		switch task.GetInfo().GetBuildID() {
+		case 1:
+			assert.Equal(t, commonpb.IndexState_InProgress, task.GetInfo().GetState())
+			assert.Nil(t, task.GetStatistic())
+		case 2:
+			assert.Equal(t, commonpb.IndexState_Finished, task.GetInfo().GetState())
+			assert.Equal(t, []string{"file1", "file2"}, task.GetInfo().GetIndexFileKeys())
+			assert.Equal(t, uint64(100), task.GetInfo().GetSerializedSize())
+			assert.Equal(t, int32(1), task.GetInfo().GetCurrentIndexVersion())
+			assert.Equal(t, int64(2), task.GetInfo().GetIndexStoreVersion())
+			assert.Equal(t, int64(10), task.GetStatistic().GetNumRows())
+			assert.Equal(t, int64(8), task.GetStatistic().GetDim())
+		default:
+			assert.Fail(t, "unexpected task", task.GetInfo().GetBuildID())
+		}
+	}
+}
+
+func TestLessTaskKey(t *testing.T) {
+	cases := []struct {
+		description string
+		a, b        taskKey
+		less        bool
+	}{
+		{"cluster first", taskKey{ClusterID: "cluster-1", BuildID: 2}, taskKey{ClusterID: "cluster-2", BuildID: 1}, true},
+		{"cluster after", taskKey{ClusterID: "cluster-2", BuildID: 1}, taskKey{ClusterID: "cluster-1", BuildID: 2}, false},
+		{"build in cluster", taskKey{ClusterID: "cluster-1", BuildID: 1}, taskKey{ClusterID: "cluster-1", BuildID: 2}, true},
+		{"equal", taskKey{ClusterID: "cluster-1", BuildID: 1}, taskKey{ClusterID: "cluster-1", BuildID: 1}, false},
+	}
+	for _, test := range cases {
+		t.Run(test.description, func(t *testing.T) {
+			assert.Equal(t, test.less, lessTaskKey(test.a, test.b))
+		})
+	}
+}
+
+func TestIndexNode_deleteAllTasksResetsDerivedState(t *testing.T) {
+	in := newTestIndexNode()
+	for buildID := UniqueID(1); buildID <= 3; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+		err := in.storeIndexFilesAndStatistic("cluster-1", buildID, []string{"file"}, 10, &indexpb.JobInfo{}, 1)
+		assert.NoError(t, err)
+	}
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	assert.Len(t, in.deleteAllTasks(), 4)
+
+	in.stateLock.Lock()
+	defer in.stateLock.Unlock()
+	assert.Empty(t, in.tasks)
+	assert.Empty(t, in.buildClusters)
+	assert.Empty(t, in.clusterSerializedSizes)
+}
+
+func TestIndexNode_logTaskStateChange(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	paramtable.Get().Save(Params.IndexNodeCfg.StateChangeLogRate.Key, "1")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.StateChangeLogRate.Key)
+	suppressed := func(clusterID string) (int64, bool) {
+		in.stateLock.Lock()
+		defer in.stateLock.Unlock()
+		limiter, ok := in.stateLogLimiters[clusterID]
+		if !ok {
+			return 0, false
+		}
+		return limiter.suppressed, true
+	}
+
+	in.loadOrStoreTask("cluster-log-rate", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-log-rate", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	// the limiter allows the burst of one second, taking one more in advance
+	for i := 0; i < 5; i++ {
+		in.storeTaskState(context.TODO(), "cluster-log-rate", 1, commonpb.IndexState_InProgress, "")
+	}
+	count, _ := suppressed("cluster-log-rate")
+	assert.Equal(t, int64(3), count)
+
+	paramtable.Get().Save(Params.IndexNodeCfg.StateChangeLogRate.Key, "0")
+	in.storeTaskState(context.TODO(), "cluster-log-rate", 1, commonpb.IndexState_Finished, "")
+	count, _ = suppressed("cluster-log-rate")
+	assert.Equal(t, int64(3), count)
+
+	// the next emitted log resets the suppressed count
+	paramtable.Get().Save(Params.IndexNodeCfg.StateChangeLogRate.Key, "1")
+	clock.Advance(time.Second)
+	in.storeTaskState(context.TODO(), "cluster-log-rate", 2, commonpb.IndexState_InProgress, "")
+	count, _ = suppressed("cluster-log-rate")
+	assert.Equal(t, int64(0), count)
+
+	// the limiter is dropped along with the cluster
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-log-rate", BuildID: 1}})
+	_, ok := suppressed("cluster-log-rate")
+	assert.True(t, ok)
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-log-rate", BuildID: 2}})
+	_, ok = suppressed("cluster-log-rate")
+	assert.False(t, ok)
+}
+
+func TestIndexNode_tasksWithFilePrefix(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"index/1/a", "index/1/b"}, 1, &indexpb.JobInfo{}, 1))
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-1", 2, []string{"index/2/a"}, 1, &indexpb.JobInfo{}, 1))
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-2", 3, []string{"index/10/a"}, 1, &indexpb.JobInfo{}, 1))
+
+	assert.ElementsMatch(t, []taskKey{{ClusterID: "cluster-1", BuildID: 1}, {ClusterID: "cluster-2", BuildID: 3}},
+		in.tasksWithFilePrefix("index/1"))
+	assert.ElementsMatch(t, []taskKey{{ClusterID: "cluster-1", BuildID: 1}}, in.tasksWithFilePrefix("index/1/"))
+	assert.ElementsMatch(t, []taskKey{{ClusterID: "cluster-1", BuildID: 2}}, in.tasksWithFilePrefix("index/2/a"))
+	assert.Len(t, in.tasksWithFilePrefix("index/"), 3)
+	assert.Empty(t, in.tasksWithFilePrefix("index/3"))
+	assert.Empty(t, in.tasksWithFilePrefix("other"))
+}
+
+func TestIndexNode_cleanupDeletedTasks(t *testing.T) {
+	in := newTestIndexNode()
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.TaskCleanupParallel.Key)
+
+	newInfos := func(hookErr error) []*taskInfo {
+		infos := make([]*taskInfo, 0)
+		for i := 0; i < 4; i++ {
+			infos = append(infos, &taskInfo{
+				cancel: func() {},
+				onDelete: func() error {
+					time.Sleep(100 * time.Millisecond)
+					return hookErr
+				},
+			})
+		}
+		return infos
+	}
+
+	t.Run("serial", func(t *testing.T) {
+		paramtable.Get().Save(Params.IndexNodeCfg.TaskCleanupParallel.Key, "1")
+		start := time.Now()
+		assert.NoError(t, in.cleanupDeletedTasks(context.TODO(), newInfos(nil)))
+		assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		paramtable.Get().Save(Params.IndexNodeCfg.TaskCleanupParallel.Key, "4")
+		start := time.Now()
+		assert.NoError(t, in.cleanupDeletedTasks(context.TODO(), newInfos(nil)))
+		assert.Less(t, time.Since(start), 400*time.Millisecond)
+	})
+
+	t.Run("hook error", func(t *testing.T) {
+		err := in.cleanupDeletedTasks(context.TODO(), newInfos(merr.ErrServiceInternal))
+		assert.ErrorIs(t, err, merr.ErrServiceInternal)
+	})
+}
+
+func TestIndexNode_deletedTaskKey(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.reconcileFromCoordinator(context.TODO(), []*indexpb.IndexTaskMeta{{ClusterID: "cluster-1", BuildID: 2}})
+	in.registerTerminalTask("cluster-1", 3, commonpb.IndexState_Finished, "")
+	assert.NoError(t, in.checkInvariants())
+
+	// the deleted tasks carry their keys to the cleanup
+	keys := []taskKey{{ClusterID: "cluster-1", BuildID: 1}, {ClusterID: "cluster-1", BuildID: 2}, {ClusterID: "cluster-1", BuildID: 3}}
+	deletedKeys := make([]taskKey, 0, len(keys))
+	for _, info := range in.deleteTaskInfos(context.TODO(), keys) {
+		deletedKeys = append(deletedKeys, info.key)
+	}
+	assert.ElementsMatch(t, keys, deletedKeys)
+}
+
+func TestIndexNode_indexTaskElapsed(t *testing.T) {
+	in := newTestIndexNode()
+	_, ok := in.indexTaskElapsed("cluster-1", 1)
+	assert.False(t, ok)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{
+		state:      commonpb.IndexState_InProgress,
+		createTime: time.Now().Add(-time.Minute),
+	})
+	elapsed, ok := in.indexTaskElapsed("cluster-1", 1)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, elapsed, time.Minute)
+
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	elapsed, ok = in.indexTaskElapsed("cluster-1", 1)
+	assert.True(t, ok)
+	time.Sleep(10 * time.Millisecond)
+	stopped, ok := in.indexTaskElapsed("cluster-1", 1)
+	assert.True(t, ok)
+	assert.Equal(t, elapsed, stopped)
+
+	// a terminal state set again doesn't move the end time
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Failed, "fail")
+	stopped, ok = in.indexTaskElapsed("cluster-1", 1)
+	assert.True(t, ok)
+	assert.Equal(t, elapsed, stopped)
+}
+
+func TestIndexNode_loadOrStoreTaskInvalid(t *testing.T) {
+	in := newTestIndexNode()
+	_, err := in.loadOrStoreTask("", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.ErrorIs(t, err, merr.ErrParameterInvalid)
+	_, err = in.loadOrStoreTask("cluster-1", 0, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.ErrorIs(t, err, merr.ErrParameterInvalid)
+	_, err = in.loadOrStoreTask("cluster-1", -1, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.ErrorIs(t, err, merr.ErrParameterInvalid)
+	assert.Empty(t, in.deleteAllTasks())
+
+	oldInfo, err := in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	assert.Nil(t, oldInfo)
+	oldInfo, err = in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	assert.NotNil(t, oldInfo)
+}
+
+func TestIndexNode_loadOrStoreTaskVersionMismatch(t *testing.T) {
+	in := newTestIndexNode()
+	oldInfo, err := in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress, currentIndexVersion: 4})
+	assert.NoError(t, err)
+	assert.Nil(t, oldInfo)
+
+	// the re-registration with different versions is logged, the existing task is kept as is
+	oldInfo, err = in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued, currentIndexVersion: 5, indexStoreVersion: 1})
+	assert.NoError(t, err)
+	assert.NotNil(t, oldInfo)
+	assert.Equal(t, int32(4), oldInfo.currentIndexVersion)
+	assert.Equal(t, int64(0), oldInfo.indexStoreVersion)
+	assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-1", 1))
+}
+
+func TestIndexNode_firstStateUpdateLatency(t *testing.T) {
+	in := newTestIndexNode()
+	metrics.IndexNodeTaskFirstUpdateLatency.Reset()
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.IndexNodeTaskFirstUpdateLatency))
+
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.IndexNodeTaskFirstUpdateLatency))
+	in.stateLock.Lock()
+	assert.True(t, in.tasks[taskKey{ClusterID: "cluster-1", BuildID: 1}].stateUpdated)
+	assert.False(t, in.tasks[taskKey{ClusterID: "cluster-2", BuildID: 1}].stateUpdated)
+	in.stateLock.Unlock()
+
+	in.storeTaskState(context.TODO(), "cluster-2", 1, commonpb.IndexState_Finished, "")
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics.IndexNodeTaskFirstUpdateLatency))
+}
+
+func TestIndexNode_countIndexTasks(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file"}, 100, &indexpb.JobInfo{}, 1))
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-2", 3, []string{"file"}, 10, &indexpb.JobInfo{}, 2))
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+
+	assert.Equal(t, 3, in.countIndexTasks(func(info *taskInfo) bool { return true }))
+	assert.Equal(t, 2, in.countIndexTasks(func(info *taskInfo) bool {
+		return info.state == commonpb.IndexState_InProgress
+	}))
+	assert.Equal(t, 1, in.countIndexTasks(func(info *taskInfo) bool {
+		return info.serializedSize > 50
+	}))
+	assert.Equal(t, 1, in.countIndexTasks(func(info *taskInfo) bool {
+		return info.currentIndexVersion == 2
+	}))
+}
+
+func TestIndexNode_storeStatisticCloneFailure(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	cloneJobInfo = func(proto.Message) proto.Message {
+		return &indexpb.IndexTaskInfo{}
+	}
+	defer func() {
+		cloneJobInfo = proto.Clone
+	}()
+	assert.NotPanics(t, func() {
+		err := in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file"}, 10, &indexpb.JobInfo{NumRows: 1}, 1)
+		assert.NoError(t, err)
+		err = in.storeIndexFilesAndStatisticV2("cluster-1", 1, []string{"file"}, 10, &indexpb.JobInfo{NumRows: 1}, 1, 1)
+		assert.NoError(t, err)
+	})
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Len(t, snapshots, 1)
+	assert.Nil(t, snapshots[0].Statistic)
+	assert.Equal(t, []string{"file"}, snapshots[0].FileKeys)
+
+	// the statistic stored is not copied into the snapshots and dumps either
+	cloneJobInfo = proto.Clone
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file"}, 10, &indexpb.JobInfo{NumRows: 1}, 1))
+	cloneJobInfo = func(proto.Message) proto.Message {
+		return &indexpb.IndexTaskInfo{}
+	}
+	assert.NotPanics(t, func() {
+		snapshots = in.indexTaskSnapshots()
+		_, err := in.DumpTasksProto()
+		assert.NoError(t, err)
+	})
+	assert.Nil(t, snapshots[0].Statistic)
+}
+
+func TestIndexNode_maxDumpedIndexFileKeys(t *testing.T) {
+	in := newTestIndexNode()
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxDumpedIndexFileKeys.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.MaxDumpedIndexFileKeys.Key)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	err := in.finishIndexTask(context.TODO(), "cluster-1", 1, IndexResult{FileKeys: []string{"files/1/a", "files/1/b", "files/1/c"}})
+	assert.NoError(t, err)
+	err = in.finishIndexTask(context.TODO(), "cluster-1", 2, IndexResult{FileKeys: []string{"files/2/a", "files/2/b"}})
+	assert.NoError(t, err)
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Equal(t, []string{"files/1/a", "files/1/b"}, snapshots[0].FileKeys)
+	assert.Equal(t, 3, snapshots[0].NumFileKeys)
+	assert.Equal(t, []string{"files/2/a", "files/2/b"}, snapshots[1].FileKeys)
+	assert.Equal(t, 2, snapshots[1].NumFileKeys)
+
+	// all the keys are retained and handed off
+	keys, ok := in.taskFileKeys("cluster-1", 1, 0)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"files/1/a", "files/1/b", "files/1/c"}, keys)
+	data, err := in.ExportState()
+	assert.NoError(t, err)
+	successor := newTestIndexNode()
+	assert.NoError(t, successor.ImportState(data))
+	keys, _ = successor.taskFileKeys("cluster-1", 1, 0)
+	assert.Equal(t, []string{"files/1/a", "files/1/b", "files/1/c"}, keys)
+}
+
+func TestIndexNode_failIndexTask(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	diag := map[string]string{"lastLog": "out of memory", "memUsed": "1024"}
+	in.failIndexTask(context.TODO(), "cluster-1", 1, "build failed", diag)
+	// the diagnostics are copied
+	diag["lastLog"] = "changed"
+	// the task which doesn't exist is ignored
+	in.failIndexTask(context.TODO(), "cluster-1", 2, "build failed", diag)
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, commonpb.IndexState_Failed, snapshots[0].State)
+	assert.Equal(t, "build failed", snapshots[0].FailReason)
+	assert.Equal(t, map[string]string{"lastLog": "out of memory", "memUsed": "1024"}, snapshots[0].Diagnostics)
+	assert.False(t, snapshots[0].EndTime.IsZero())
+	assert.Equal(t, 1, in.retainedFailedTasks("cluster-1"))
+}
+
+func TestIndexNode_dedupTaskFiles(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Equal(t, 0, in.dedupTaskFiles("cluster-1", 1))
+
+	// the duplicates are dropped on store
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	err := in.finishIndexTask(context.TODO(), "cluster-1", 1, IndexResult{
+		FileKeys:       []string{"files/1/a", "files/1/b", "files/1/a"},
+		SerializedSize: 100,
+	})
+	assert.NoError(t, err)
+	snapshots := in.indexTaskSnapshots()
+	assert.Equal(t, []string{"files/1/a", "files/1/b"}, snapshots[0].FileKeys)
+	assert.Equal(t, 2, snapshots[0].NumFileKeys)
+	assert.Equal(t, 0, in.dedupTaskFiles("cluster-1", 1))
+
+	// the duplicates injected bypassing the store
+	in.stateLock.Lock()
+	in.tasks[taskKey{ClusterID: "cluster-1", BuildID: 1}].fileKeys = newIndexFileKeys(
+		[]string{"files/1/a", "files/1/b", "files/1/b", "files/1/c", "files/1/a"})
+	in.stateLock.Unlock()
+	assert.Equal(t, 2, in.dedupTaskFiles("cluster-1", 1))
+	snapshots = in.indexTaskSnapshots()
+	assert.Equal(t, []string{"files/1/a", "files/1/b", "files/1/c"}, snapshots[0].FileKeys)
+	assert.Equal(t, 3, snapshots[0].NumFileKeys)
+	assert.Equal(t, uint64(100), snapshots[0].SerializedSize)
+}
+
+func TestIndexNode_storeIndexFilesAndStatisticWithVersion(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	_, ok := in.loadTaskVersion("cluster-1", 2)
+	assert.False(t, ok)
+	version, ok := in.loadTaskVersion("cluster-1", 1)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), version)
+
+	// a concurrent writer updates the task after the version is loaded
+	err := in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file-a"}, 10, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+	err = in.storeIndexFilesAndStatisticWithVersion("cluster-1", 1, version, []string{"file-b"}, 20, &indexpb.JobInfo{}, 1)
+	assert.ErrorIs(t, err, merr.ErrParameterInvalid)
+	snapshots := in.indexTaskSnapshots()
+	assert.Equal(t, []string{"file-a"}, snapshots[0].FileKeys)
+
+	version, _ = in.loadTaskVersion("cluster-1", 1)
+	assert.Equal(t, uint64(1), version)
+	err = in.storeIndexFilesAndStatisticWithVersion("cluster-1", 1, version, []string{"file-b"}, 20, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+	snapshots = in.indexTaskSnapshots()
+	assert.Equal(t, []string{"file-b"}, snapshots[0].FileKeys)
+	assert.Equal(t, uint64(20), in.clusterSerializedSize("cluster-1"))
+
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	version, _ = in.loadTaskVersion("cluster-1", 1)
+	assert.Equal(t, uint64(3), version)
+
+	// missing task is a no-op, same as the unconditional path
+	err = in.storeIndexFilesAndStatisticWithVersion("cluster-1", 2, 0, nil, 0, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+}
+
+func TestIndexNode_cancelTask(t *testing.T) {
+	in := newTestIndexNode()
+	ctx, cancel := context.WithCancel(context.Background())
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{cancel: cancel, state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	assert.False(t, in.cancelTask("cluster-1", 3, "dropped"))
+	assert.True(t, in.cancelTask("cluster-1", 1, "dropped"))
+	assert.Error(t, ctx.Err())
+
+	// the scheduler reports the cancelled task with the context error
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Retry, "canceled")
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Failed, "build failed")
+	assert.False(t, in.cancelTask("cluster-1", 2, "dropped"))
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Len(t, snapshots, 2)
+	assert.True(t, snapshots[0].Cancelled)
+	assert.Equal(t, "dropped", snapshots[0].CancelReason)
+	assert.Empty(t, snapshots[0].FailReason)
+	assert.False(t, snapshots[1].Cancelled)
+	assert.Empty(t, snapshots[1].CancelReason)
+	assert.Equal(t, "build failed", snapshots[1].FailReason)
+
+	failed := in.countIndexTasks(func(info *taskInfo) bool {
+		return isTerminalState(info.state) && !info.cancelled
+	})
+	assert.Equal(t, 1, failed)
+}
+
+func TestIndexNode_storeTaskStateNilContext(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	var ctx context.Context
+	assert.NotPanics(t, func() {
+		in.storeTaskState(ctx, "cluster-1", 1, commonpb.IndexState_Finished, "")
+		in.storeTaskState(ctx, "cluster-1", 2, commonpb.IndexState_Finished, "")
+	})
+	assert.Equal(t, commonpb.IndexState_Finished, in.loadTaskState("cluster-1", 1))
+}
+
+func TestIndexNode_retainedFailedTasks(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxRetainedFailedTasksPerCluster.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.MaxRetainedFailedTasksPerCluster.Key)
+
+	in := newTestIndexNode()
+	onDeleted := make([]UniqueID, 0)
+	for buildID := UniqueID(1); buildID <= 4; buildID++ {
+		buildID := buildID
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{
+			state: commonpb.IndexState_InProgress,
+			onDelete: func() error {
+				onDeleted = append(onDeleted, buildID)
+				return nil
+			},
+		})
+	}
+	in.loadOrStoreTask("cluster-2", 5, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Failed, "failed")
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Failed, "failed")
+	in.storeTaskState(context.TODO(), "cluster-2", 5, commonpb.IndexState_Failed, "failed")
+	assert.Equal(t, 2, in.retainedFailedTasks("cluster-1"))
+	assert.Equal(t, 1, in.retainedFailedTasks("cluster-2"))
+
+	// the third failure of cluster-1 evicts the oldest one
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Failed, "failed")
+	assert.Equal(t, 2, in.retainedFailedTasks("cluster-1"))
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 1))
+	assert.Equal(t, commonpb.IndexState_Failed, in.loadTaskState("cluster-1", 2))
+	assert.Equal(t, []UniqueID{1}, onDeleted)
+	assert.Equal(t, 1, in.retainedFailedTasks("cluster-2"))
+
+	// repeated failure updates don't count twice, deleted ones are forgotten
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Failed, "failed again")
+	assert.Equal(t, 2, in.retainedFailedTasks("cluster-1"))
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 2}})
+	assert.Equal(t, 1, in.retainedFailedTasks("cluster-1"))
+	in.storeTaskState(context.TODO(), "cluster-1", 4, commonpb.IndexState_Failed, "failed")
+	assert.Equal(t, 2, in.retainedFailedTasks("cluster-1"))
+	assert.Equal(t, commonpb.IndexState_Failed, in.loadTaskState("cluster-1", 3))
+
+	assert.NoError(t, in.checkInvariants())
+
+	in.deleteAllTasks()
+	assert.Equal(t, 0, in.retainedFailedTasks("cluster-1"))
+}
+
+func TestIndexNode_queuedTasks(t *testing.T) {
+	in := newTestIndexNode()
+	for buildID := UniqueID(1); buildID <= 4; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_Unissued})
+	}
+	in.loadOrStoreTask("cluster-1", 5, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.reconcileFromCoordinator(context.TODO(), []*indexpb.IndexTaskMeta{{ClusterID: "cluster-1", BuildID: 6}})
+	// the queued tasks are pending, the reconciled placeholders are not
+	assert.True(t, in.hasInProgressTask())
+	assert.Len(t, in.inProgressTaskKeys(), 5)
+	snapshots := in.pendingTaskSnapshots()
+	assert.Len(t, snapshots, 5)
+	assert.Equal(t, UniqueID(5), snapshots[4].BuildID)
+}
+
+func TestIndexNode_dequeueForExecution(t *testing.T) {
+	in := newTestIndexNode()
+	for buildID := UniqueID(1); buildID <= 4; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_Unissued})
+	}
+	in.reconcileFromCoordinator(context.TODO(), []*indexpb.IndexTaskMeta{{ClusterID: "cluster-1", BuildID: 5}})
+	// the tasks cancelled or failed while queued are not run
+	assert.True(t, in.cancelTask("cluster-1", 2, "dropped"))
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Failed, "build failed")
+	keys := make([]taskKey, 0, 6)
+	for buildID := UniqueID(1); buildID <= 6; buildID++ {
+		keys = append(keys, taskKey{ClusterID: "cluster-1", BuildID: buildID})
+	}
+
+	dequeued := in.dequeueForExecution(context.TODO(), keys)
+	assert.Equal(t, []taskKey{{ClusterID: "cluster-1", BuildID: 1}, {ClusterID: "cluster-1", BuildID: 4}}, dequeued)
+	assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-1", 1))
+	assert.Equal(t, commonpb.IndexState_Unissued, in.loadTaskState("cluster-1", 2))
+	assert.Equal(t, commonpb.IndexState_Failed, in.loadTaskState("cluster-1", 3))
+	assert.Equal(t, commonpb.IndexState_Unissued, in.loadTaskState("cluster-1", 5))
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 6))
+	in.stateLock.Lock()
+	assert.False(t, in.tasks[keys[0]].startTime.IsZero())
+	in.stateLock.Unlock()
+
+	// the running task is not dequeued again
+	assert.Empty(t, in.dequeueForExecution(context.TODO(), keys[:1]))
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestIndexNode_deleteTasksWhere(t *testing.T) {
+	in := newTestIndexNode()
+	cancelled := 0
+	cancel := func() { cancelled++ }
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Failed, cancel: cancel})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_Failed, cancel: cancel})
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_Finished, cancel: cancel})
+
+	assert.Empty(t, in.deleteTasksWhere(context.TODO(), func(info *taskInfo) bool {
+		return info.state == commonpb.IndexState_Retry
+	}))
+
+	deleted := in.deleteTasksWhere(context.TODO(), func(info *taskInfo) bool {
+		return info.state == commonpb.IndexState_Failed
+	})
+	assert.Len(t, deleted, 2)
+	assert.Equal(t, 2, cancelled)
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 2))
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-2", 3))
+
+	deleted = in.deleteTasksWhere(context.TODO(), func(info *taskInfo) bool {
+		return isTerminalState(info.state)
+	})
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, commonpb.IndexState_Finished, deleted[0].state)
+	assert.Equal(t, 3, cancelled)
+	assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-1", 1))
+}
+
+func TestIndexNode_purgeFinishedForCluster(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Finished, "")
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.storeTaskState(context.TODO(), "cluster-1", 4, commonpb.IndexState_Failed, "build failed")
+	in.loadOrStoreTask("cluster-1", 5, &taskInfo{state: commonpb.IndexState_Retry})
+	in.loadOrStoreTask("cluster-2", 6, &taskInfo{state: commonpb.IndexState_Finished})
+
+	assert.Equal(t, 3, in.purgeFinishedForCluster("cluster-1"))
+	assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-1", 1))
+	assert.Equal(t, commonpb.IndexState_Unissued, in.loadTaskState("cluster-1", 2))
+	for buildID := UniqueID(3); buildID <= 5; buildID++ {
+		assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", buildID))
+	}
+	// the other clusters are not affected
+	assert.Equal(t, commonpb.IndexState_Finished, in.loadTaskState("cluster-2", 6))
+	assert.Equal(t, 0, in.purgeFinishedForCluster("cluster-1"))
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestIndexNode_clusterJobStats(t *testing.T) {
+	in := newTestIndexNode()
+	stats := in.clusterJobStats("cluster-1")
+	assert.NotNil(t, stats)
+	assert.Equal(t, "cluster-1", stats.GetClusterID())
+	assert.Equal(t, int64(0), stats.GetTaskNum())
+
+	for buildID := UniqueID(1); buildID <= 4; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+	}
+	in.loadOrStoreTask("cluster-2", 5, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.storeIndexFilesAndStatistic("cluster-1", 1, nil, 0, &indexpb.JobInfo{NumRows: 100, StartTime: 1000, EndTime: 3000}, 1)
+	in.storeIndexFilesAndStatistic("cluster-1", 2, nil, 0, &indexpb.JobInfo{NumRows: 200, StartTime: 2000, EndTime: 2500}, 1)
+	// the statistic without a valid build time
+	in.storeIndexFilesAndStatistic("cluster-1", 3, nil, 0, &indexpb.JobInfo{NumRows: 300, StartTime: 2000}, 1)
+	in.storeIndexFilesAndStatistic("cluster-2", 5, nil, 0, &indexpb.JobInfo{NumRows: 1000, StartTime: 1000, EndTime: 9000}, 1)
+
+	stats = in.clusterJobStats("cluster-1")
+	assert.Equal(t, int64(3), stats.GetTaskNum())
+	assert.Equal(t, int64(600), stats.GetNumRows())
+	assert.Equal(t, int64(2500), stats.GetBuildTime())
+	stats = in.clusterJobStats("cluster-2")
+	assert.Equal(t, int64(1), stats.GetTaskNum())
+	assert.Equal(t, int64(1000), stats.GetNumRows())
+	assert.Equal(t, int64(8000), stats.GetBuildTime())
+}
+
+func TestJobInfoToMetrics(t *testing.T) {
+	stats := jobInfoToMetrics(&indexpb.JobInfo{
+		NumRows:   1000,
+		Dim:       128,
+		StartTime: 1_000_000,
+		EndTime:   3_500_000,
+		PodID:     1,
+	})
+	assert.Equal(t, map[string]float64{
+		"num_rows":      1000,
+		"dim":           128,
+		"build_seconds": 2.5,
+	}, stats)
+
+	// the build time is skipped until the task ends
+	stats = jobInfoToMetrics(&indexpb.JobInfo{NumRows: 1000, StartTime: 1_000_000})
+	assert.NotContains(t, stats, "build_seconds")
+
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-stats", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	err := in.storeIndexFilesAndStatistic("cluster-stats", 1, []string{"file"}, 10, &indexpb.JobInfo{NumRows: 1000, Dim: 128}, 1)
+	assert.NoError(t, err)
+	in.storeTaskState(context.TODO(), "cluster-stats", 1, commonpb.IndexState_Finished, "")
+	nodeID := strconv.FormatInt(paramtable.GetNodeID(), 10)
+	assert.Equal(t, 1000.0, testutil.ToFloat64(metrics.IndexNodeFinishedTaskStats.WithLabelValues(nodeID, "cluster-stats", "num_rows")))
+	assert.Equal(t, 128.0, testutil.ToFloat64(metrics.IndexNodeFinishedTaskStats.WithLabelValues(nodeID, "cluster-stats", "dim")))
+	assert.ElementsMatch(t, jobStatNames, maps.Keys(jobInfoToMetrics(&indexpb.JobInfo{StartTime: 1, EndTime: 2})))
+}
+
+func TestIndexNode_deleteClusterMetrics(t *testing.T) {
+	in := newTestIndexNode()
+	metrics.IndexNodeTaskFirstUpdateLatency.Reset()
+	metrics.IndexNodeFinishedTaskStats.Reset()
+	metrics.IndexNodeCancelledTaskRatio.Reset()
+	countMetrics := func() int {
+		return testutil.CollectAndCount(metrics.IndexNodeTaskFirstUpdateLatency) +
+			testutil.CollectAndCount(metrics.IndexNodeFinishedTaskStats) +
+			testutil.CollectAndCount(metrics.IndexNodeCancelledTaskRatio)
+	}
+
+	for _, clusterID := range []string{"cluster-1", "cluster-2"} {
+		for buildID := UniqueID(1); buildID <= 2; buildID++ {
+			in.loadOrStoreTask(clusterID, buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+		}
+		err := in.storeIndexFilesAndStatistic(clusterID, 1, []string{"file"}, 10,
+			&indexpb.JobInfo{NumRows: 1000, Dim: 128, StartTime: 1_000_000, EndTime: 2_000_000}, 1)
+		assert.NoError(t, err)
+		in.storeTaskState(context.TODO(), clusterID, 1, commonpb.IndexState_Finished, "")
+	}
+	// the first update latency, the cancelled ratio and the job stats of each cluster
+	assert.Equal(t, 2*(2+len(jobStatNames)), countMetrics())
+
+	// the metrics are kept until the cluster has no task left
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 1}})
+	assert.Equal(t, 2*(2+len(jobStatNames)), countMetrics())
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 2}})
+	assert.Equal(t, 2+len(jobStatNames), countMetrics())
+
+	in.deleteAllTasks()
+	assert.Equal(t, 0, countMetrics())
+}
+
+func TestIndexNode_finishIndexTask(t *testing.T) {
+	in := newTestIndexNode()
+	const taskNum = 100
+	for buildID := UniqueID(1); buildID <= taskNum; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+	}
+
+	done := make(chan struct{})
+	inconsistent := atomic.NewInt32(0)
+	go func() {
+		defer close(done)
+		for {
+			for _, snapshot := range in.indexTaskSnapshots() {
+				if len(snapshot.FileKeys) > 0 && snapshot.State != commonpb.IndexState_Finished {
+					inconsistent.Inc()
+				}
+			}
+			if in.countIndexTasks(func(info *taskInfo) bool {
+				return info.state == commonpb.IndexState_Finished
+			}) == taskNum {
+				return
+			}
+		}
+	}()
+	for buildID := UniqueID(1); buildID <= taskNum; buildID++ {
+		err := in.finishIndexTask(context.TODO(), "cluster-1", buildID, IndexResult{
+			FileKeys:            []string{"file"},
+			SerializedSize:      10,
+			Statistic:           &indexpb.JobInfo{NumRows: 100},
+			CurrentIndexVersion: 1,
+			IndexStoreVersion:   2,
+		})
+		assert.NoError(t, err)
+	}
+	<-done
+	assert.Equal(t, int32(0), inconsistent.Load())
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Equal(t, []string{"file"}, snapshots[0].FileKeys)
+	assert.Equal(t, int64(100), snapshots[0].Statistic.GetNumRows())
+	assert.Equal(t, int32(1), snapshots[0].CurrentIndexVersion)
+	assert.Equal(t, int64(2), snapshots[0].IndexStoreVersion)
+	assert.False(t, snapshots[0].EndTime.IsZero())
+	assert.Equal(t, uint64(taskNum*10), in.clusterSerializedSize("cluster-1"))
+
+	// the missing task is ignored
+	assert.NoError(t, in.finishIndexTask(context.TODO(), "cluster-1", taskNum+1, IndexResult{}))
+}
+
+func TestIndexNode_cancelIndexTasks(t *testing.T) {
+	in := newTestIndexNode()
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{cancel: cancel1, state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{cancel: cancel2, state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{cancel: cancel3, state: commonpb.IndexState_Finished})
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	cancelled := in.cancelIndexTasks([]taskKey{
+		{ClusterID: "cluster-1", BuildID: 1},
+		{ClusterID: "cluster-1", BuildID: 2},
+		{ClusterID: "cluster-1", BuildID: 3},
+		{ClusterID: "cluster-1", BuildID: 5},
+		{ClusterID: "cluster-2", BuildID: 1},
+	})
+	assert.Equal(t, 2, cancelled)
+	assert.Error(t, ctx1.Err())
+	assert.Error(t, ctx2.Err())
+	assert.NoError(t, ctx3.Err())
+
+	// the records are kept
+	snapshots := in.indexTaskSnapshots()
+	assert.Len(t, snapshots, 4)
+	assert.True(t, snapshots[0].Cancelled)
+	assert.True(t, snapshots[1].Cancelled)
+	assert.False(t, snapshots[2].Cancelled)
+	assert.False(t, snapshots[3].Cancelled)
+	assert.Equal(t, 0, in.cancelIndexTasks(nil))
+	cancel3()
+}
+
+func TestIndexNode_throughputSince(t *testing.T) {
+	in := newTestIndexNode()
+	now := time.Now()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Finished, serializedSize: 100, endTime: now.Add(-2 * time.Minute)})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Finished, serializedSize: 300, endTime: now.Add(-30 * time.Second)})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_Finished, serializedSize: 600, endTime: now.Add(-10 * time.Second)})
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_Failed, serializedSize: 1000, endTime: now.Add(-10 * time.Second)})
+
+	// 900 bytes in about 60 seconds
+	assert.InDelta(t, 15.0, in.throughputSince(now.Add(-time.Minute)), 0.1)
+	assert.InDelta(t, 1000.0/180, in.throughputSince(now.Add(-3*time.Minute)), 0.1)
+	assert.Equal(t, 0.0, in.throughputSince(now.Add(time.Minute)))
+}
+
+func TestIndexNode_taskAgeDistribution(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	assert.Equal(t, map[string]int{"<1m": 0, "1m-10m": 0, "10m-1h": 0, ">1h": 0}, in.taskAgeDistribution())
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Finished})
+	clock.Advance(time.Hour)
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Finished})
+	clock.Advance(50 * time.Minute)
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+	clock.Advance(5 * time.Minute)
+	in.loadOrStoreTask("cluster-2", 5, &taskInfo{state: commonpb.IndexState_Unissued})
+	clock.Advance(30 * time.Second)
+
+	assert.Equal(t, map[string]int{"<1m": 1, "1m-10m": 2, "10m-1h": 1, ">1h": 1}, in.taskAgeDistribution())
+}
+
+func TestIndexNode_oldestQueuedAgePerCluster(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	assert.Len(t, in.oldestQueuedAgePerCluster(), 0)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	// the running and terminal tasks are not queued
+	in.loadOrStoreTask("cluster-2", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_Finished})
+	clock.Advance(time.Hour)
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-2", 5, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.reconcileFromCoordinator(context.TODO(), []*indexpb.IndexTaskMeta{{ClusterID: "cluster-3", BuildID: 6}})
+	clock.Advance(10 * time.Minute)
+	in.loadOrStoreTask("cluster-2", 7, &taskInfo{state: commonpb.IndexState_Unissued})
+	clock.Advance(time.Minute)
+
+	assert.Equal(t, map[string]time.Duration{
+		"cluster-1": 71 * time.Minute,
+		"cluster-2": 11 * time.Minute,
+	}, in.oldestQueuedAgePerCluster())
+
+	// the oldest queued task starts to run
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+	assert.Equal(t, 11*time.Minute, in.oldestQueuedAgePerCluster()["cluster-1"])
+}
+
+func TestIndexNode_canCancel(t *testing.T) {
+	in := newTestIndexNode()
+	cancel := func() {}
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued, cancel: cancel})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.setTaskUncancellable("cluster-1", 4, true)
+	for buildID, state := range map[UniqueID]commonpb.IndexState{
+		5: commonpb.IndexState_Finished,
+		6: commonpb.IndexState_Failed,
+		7: commonpb.IndexState_Retry,
+	} {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+		in.storeTaskState(context.TODO(), "cluster-1", buildID, state, "")
+	}
+
+	assert.True(t, in.canCancel("cluster-1", 1))
+	assert.True(t, in.canCancel("cluster-1", 2))
+	// no cancel func
+	assert.False(t, in.canCancel("cluster-1", 3))
+	// uncancellable
+	assert.False(t, in.canCancel("cluster-1", 4))
+	in.setTaskUncancellable("cluster-1", 4, false)
+	assert.True(t, in.canCancel("cluster-1", 4))
+	// terminal
+	assert.False(t, in.canCancel("cluster-1", 5))
+	assert.False(t, in.canCancel("cluster-1", 6))
+	assert.False(t, in.canCancel("cluster-1", 7))
+	// not exist
+	assert.False(t, in.canCancel("cluster-1", 8))
+	assert.False(t, in.canCancel("cluster-2", 1))
+}
+
+func TestIndexNode_finishWithoutFiles(t *testing.T) {
+	in := newTestIndexNode()
+	for buildID := UniqueID(1); buildID <= 6; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+	}
+	in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file1"}, 10, nil, 1)
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	// the task built into the storage v2 doesn't report file keys
+	assert.NoError(t, in.finishIndexTask(context.TODO(), "cluster-1", 5, IndexResult{CurrentIndexVersion: 1, IndexStoreVersion: 1}))
+	// the task without files is only logged by default
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Finished, "")
+	assert.Equal(t, commonpb.IndexState_Finished, in.loadTaskState("cluster-1", 2))
+	// the failed task without files is not taken
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Failed, "build failed")
+	assert.Equal(t, []taskKey{{ClusterID: "cluster-1", BuildID: 2}}, in.finishedTasksWithNoFiles())
+
+	paramtable.Get().Save(Params.IndexNodeCfg.FailFinishedTaskWithoutFiles.Key, "true")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.FailFinishedTaskWithoutFiles.Key)
+	in.storeTaskState(context.TODO(), "cluster-1", 4, commonpb.IndexState_Finished, "")
+	assert.Equal(t, commonpb.IndexState_Failed, in.loadTaskState("cluster-1", 4))
+	assert.Equal(t, finishedWithoutFilesReason, in.indexTaskSnapshots()[3].FailReason)
+	assert.Equal(t, []taskKey{{ClusterID: "cluster-1", BuildID: 2}}, in.finishedTasksWithNoFiles())
+	assert.Equal(t, commonpb.IndexState_Finished, in.loadTaskState("cluster-1", 5))
+
+	// the task failed by finishIndexTask evicts the failed tasks beyond the retention
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxRetainedFailedTasksPerCluster.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.MaxRetainedFailedTasksPerCluster.Key)
+	assert.NoError(t, in.finishIndexTask(context.TODO(), "cluster-1", 6, IndexResult{}))
+	assert.Equal(t, commonpb.IndexState_Failed, in.loadTaskState("cluster-1", 6))
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 3))
+	assert.Equal(t, 2, in.retainedFailedTasks("cluster-1"))
+	assert.Empty(t, in.deletingTasks)
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestIndexNode_setTaskUncancellable(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	cancelled := make(map[UniqueID]int)
+	newTask := func(buildID UniqueID) *taskInfo {
+		return &taskInfo{state: commonpb.IndexState_InProgress, cancel: func() { cancelled[buildID]++ }}
+	}
+	in.loadOrStoreTask("cluster-1", 1, newTask(1))
+	clock.Advance(time.Minute)
+	in.loadOrStoreTask("cluster-1", 2, newTask(2))
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+	clock.Advance(time.Minute)
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_InProgress, "")
+	in.setTaskUncancellable("cluster-1", 1, true)
+
+	// the longest running task is uncancellable, the next one is shed
+	key, ok := in.cancelLongestRunningTask()
+	assert.True(t, ok)
+	assert.Equal(t, UniqueID(2), key.BuildID)
+	_, ok = in.cancelLongestRunningTask()
+	assert.False(t, ok)
+	assert.False(t, in.cancelTask("cluster-1", 1, "cancelled by request"))
+	assert.Equal(t, 0, in.cancelIndexTasks([]taskKey{{ClusterID: "cluster-1", BuildID: 1}}))
+	assert.Equal(t, ReapResult{}, in.reapTasksOlderThan(context.TODO(), 0))
+	// only the cancelled task still running is failed
+	assert.Equal(t, 1, in.failAllInProgress("storage unreachable"))
+	assert.Equal(t, map[UniqueID]int{2: 2}, cancelled)
+	snapshots := in.indexTaskSnapshots()
+	assert.False(t, snapshots[0].Cancelled)
+	assert.Equal(t, commonpb.IndexState_InProgress, snapshots[0].State)
+
+	// the uncancellable task is not cancelled by shutdown either
+	report := in.cleanupAllTasks(context.TODO(), false, 0)
+	assert.Equal(t, ShutdownReport{Dropped: 1, AlreadyTerminal: 1}, report)
+	assert.Equal(t, 0, cancelled[1])
+
+	// the task is cancellable once it's unmarked
+	in.loadOrStoreTask("cluster-1", 3, newTask(3))
+	in.setTaskUncancellable("cluster-1", 3, true)
+	in.setTaskUncancellable("cluster-1", 3, false)
+	assert.True(t, in.cancelTask("cluster-1", 3, "cancelled by request"))
+	assert.Equal(t, 1, cancelled[3])
+}
+
+func TestIndexNode_failAllInProgress(t *testing.T) {
+	in := newTestIndexNode()
+	cancelled := 0
+	cancel := func() { cancelled++ }
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.loadOrStoreTask("cluster-2", 2, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_Unissued, cancel: cancel})
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.storeTaskState(context.TODO(), "cluster-1", 4, commonpb.IndexState_Finished, "")
+	in.loadOrStoreTask("cluster-1", 5, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.storeTaskState(context.TODO(), "cluster-1", 5, commonpb.IndexState_Failed, "build failed")
+
+	assert.Equal(t, 2, in.failAllInProgress("storage unreachable"))
+	assert.Equal(t, 2, cancelled)
+	snapshots := in.indexTaskSnapshots()
+	states := make(map[UniqueID]commonpb.IndexState)
+	for _, snapshot := range snapshots {
+		states[snapshot.BuildID] = snapshot.State
+		if snapshot.BuildID == 1 || snapshot.BuildID == 2 {
+			assert.Equal(t, "storage unreachable", snapshot.FailReason)
+			assert.False(t, snapshot.Cancelled)
+		}
+	}
+	assert.Equal(t, map[UniqueID]commonpb.IndexState{
+		1: commonpb.IndexState_Failed,
+		2: commonpb.IndexState_Failed,
+		3: commonpb.IndexState_Unissued,
+		4: commonpb.IndexState_Finished,
+		5: commonpb.IndexState_Failed,
+	}, states)
+	assert.Equal(t, "build failed", snapshots[3].FailReason)
+
+	// the cancelled builds report retry, which doesn't override the failure
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Retry, "canceled")
+	assert.Equal(t, commonpb.IndexState_Failed, in.loadTaskState("cluster-1", 1))
+	assert.Equal(t, "storage unreachable", in.indexTaskSnapshots()[0].FailReason)
+	assert.Equal(t, 2, in.retainedFailedTasks("cluster-1"))
+
+	assert.Equal(t, 0, in.failAllInProgress("storage unreachable"))
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestIndexNode_reapTasksOlderThan(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	cancelled := 0
+	cancel := func() { cancelled++ }
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued, cancel: cancel})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Unissued, cancel: cancel})
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_InProgress, "")
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Finished, "")
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress, cancel: cancel})
+	clock.Advance(time.Hour)
+	in.storeTaskState(context.TODO(), "cluster-1", 4, commonpb.IndexState_Failed, "build failed")
+	in.loadOrStoreTask("cluster-1", 5, &taskInfo{state: commonpb.IndexState_Unissued, cancel: cancel})
+	in.storeTaskState(context.TODO(), "cluster-1", 5, commonpb.IndexState_InProgress, "")
+	clock.Advance(10 * time.Minute)
+
+	// the queued task is not cancelled, the aged running task is cancelled, and the aged terminal task is deleted
+	result := in.reapTasksOlderThan(context.TODO(), 30*time.Minute)
+	assert.Equal(t, ReapResult{Cancelled: 1, Deleted: 1}, result)
+	assert.Equal(t, 2, cancelled)
+	snapshots := in.indexTaskSnapshots()
+	assert.Len(t, snapshots, 4)
+	assert.True(t, snapshots[1].Cancelled)
+	assert.False(t, snapshots[3].Cancelled)
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 3))
+
+	// the cancelled task is not cancelled again
+	result = in.reapTasksOlderThan(context.TODO(), 30*time.Minute)
+	assert.Equal(t, ReapResult{}, result)
+}
+
+func TestIndexNode_recentAdmissionDecisions(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.QuarantineFailureThreshold.Key, "1")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.QuarantineFailureThreshold.Key)
+	in := newTestIndexNode()
+	assert.Len(t, in.recentAdmissionDecisions(10), 0)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.failIndexTask(context.TODO(), "cluster-1", 1, "build failed", nil)
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 1}})
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	decisions := in.recentAdmissionDecisions(10)
+	outcomes := make([]AdmissionOutcome, 0, len(decisions))
+	for _, decision := range decisions {
+		outcomes = append(outcomes, decision.Outcome)
+	}
+	assert.Equal(t, []AdmissionOutcome{
+		admissionRejectedQuarantine,
+		admissionRejectedInvalid,
+		admissionRejectedDuplicate,
+		admissionAdmitted,
+	}, outcomes)
+	assert.Contains(t, decisions[0].Reason, "quarantined")
+	assert.Equal(t, UniqueID(2), decisions[1].BuildID)
+	assert.Len(t, in.recentAdmissionDecisions(2), 2)
+	assert.Equal(t, admissionRejectedQuarantine, in.recentAdmissionDecisions(1)[0].Outcome)
+
+	// only the recent decisions are kept
+	for buildID := UniqueID(10); buildID < 10+maxAdmissionDecisions+5; buildID++ {
+		in.loadOrStoreTask("cluster-2", buildID, &taskInfo{state: commonpb.IndexState_Unissued})
+	}
+	decisions = in.recentAdmissionDecisions(2 * maxAdmissionDecisions)
+	assert.Len(t, decisions, maxAdmissionDecisions)
+	assert.Equal(t, UniqueID(10+maxAdmissionDecisions+4), decisions[0].BuildID)
+	assert.Equal(t, UniqueID(15), decisions[maxAdmissionDecisions-1].BuildID)
+}
+
+func TestIndexNode_Ready(t *testing.T) {
+	in := newTestIndexNode()
+	paramtable.Get().Save(Params.IndexNodeCfg.ReadyMaxPendingTasks.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.ReadyMaxPendingTasks.Key)
+
+	ready, reason := in.Ready()
+	assert.True(t, ready)
+	assert.Empty(t, reason)
+	assert.Equal(t, commonpb.StateCode_Healthy, in.taskReadinessState(1).GetStateCode())
+
+	// the reconciled tasks are not created again yet
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued, reconciled: true})
+	ready, reason = in.Ready()
+	assert.False(t, ready)
+	assert.Contains(t, reason, "reconciliation in progress")
+	state := in.taskReadinessState(1)
+	assert.Equal(t, commonpb.StateCode_Initializing, state.GetStateCode())
+	assert.Equal(t, reason, state.GetExtraInfo()[0].GetValue())
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	ready, _ = in.Ready()
+	assert.True(t, ready)
+
+	// the pending tasks exceed the limit
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	ready, reason = in.Ready()
+	assert.False(t, ready)
+	assert.Contains(t, reason, "3 pending tasks")
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Finished, "")
+	ready, _ = in.Ready()
+	assert.True(t, ready)
+
+	paramtable.Get().Save(Params.IndexNodeCfg.ReadyMaxPendingTasks.Key, "0")
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+	ready, _ = in.Ready()
+	assert.True(t, ready)
+}
+
+func TestIndexNode_distinctClusterCount(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.MaxDistinctClusters.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.MaxDistinctClusters.Key)
+	in := newTestIndexNode()
+	assert.Equal(t, 0, in.distinctClusterCount())
+
+	_, err := in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	_, err = in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	in.reconcileFromCoordinator(context.TODO(), []*indexpb.IndexTaskMeta{{ClusterID: "cluster-2", BuildID: 3}})
+	assert.Equal(t, 2, in.distinctClusterCount())
+
+	// the new cluster over the limit is only warned by default
+	_, err = in.loadOrStoreTask("cluster-3", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, in.distinctClusterCount())
+
+	paramtable.Get().Save(Params.IndexNodeCfg.RejectClustersOverLimit.Key, "true")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.RejectClustersOverLimit.Key)
+	_, err = in.loadOrStoreTask("cluster-4", 5, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.ErrorIs(t, err, merr.ErrServiceQuotaExceeded)
+	assert.Equal(t, admissionRejectedClusterLimit, in.recentAdmissionDecisions(1)[0].Outcome)
+	// the clusters already served are not limited
+	_, err = in.loadOrStoreTask("cluster-1", 6, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	_, err = in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, in.distinctClusterCount())
+	assert.NoError(t, in.checkInvariants())
+
+	// the cluster is not counted once all its tasks are deleted
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-3", BuildID: 4}})
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-2", BuildID: 3}})
+	assert.Equal(t, 1, in.distinctClusterCount())
+	_, err = in.loadOrStoreTask("cluster-4", 5, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, in.distinctClusterCount())
+	assert.NoError(t, in.checkInvariants())
+
+	in.deleteAllTasks()
+	assert.Equal(t, 0, in.distinctClusterCount())
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestIndexNode_registrationRate(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	assert.Equal(t, float64(0), in.registrationRate(time.Minute))
+	assert.Equal(t, float64(0), in.registrationRate(0))
+
+	buildID := UniqueID(0)
+	burst := func(n int) {
+		for idx := 0; idx < n; idx++ {
+			buildID++
+			in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_Unissued})
+		}
+	}
+	burst(60)
+	clock.Advance(10 * time.Minute)
+	burst(30)
+	clock.Advance(30 * time.Second)
+	burst(90)
+	// the rejected registrations are not counted
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	clock.Advance(30 * time.Second)
+
+	assert.Equal(t, float64(90)/60, in.registrationRate(time.Minute))
+	assert.Equal(t, float64(120)/120, in.registrationRate(2*time.Minute))
+	assert.Equal(t, float64(180)/3600, in.registrationRate(time.Hour))
+
+	// only the recent registrations are kept
+	burst(maxRecentRegistrations)
+	assert.Equal(t, float64(maxRecentRegistrations)/3600, in.registrationRate(time.Hour))
+}
+
+func TestIndexNode_rebuildVsNewCounts(t *testing.T) {
+	in := newTestIndexNode()
+	rebuild, new := in.rebuildVsNewCounts()
+	assert.Equal(t, 0, rebuild)
+	assert.Equal(t, 0, new)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress, isRebuild: true})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_Finished, isRebuild: true})
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-2", 5, &taskInfo{state: commonpb.IndexState_Unissued, isRebuild: true})
+	rebuild, new = in.rebuildVsNewCounts()
+	assert.Equal(t, 3, rebuild)
+	assert.Equal(t, 2, new)
+}
+
+func TestIndexNode_isRebuildAssignment(t *testing.T) {
+	in := newTestIndexNode()
+	key := taskKey{ClusterID: "cluster-1", BuildID: 1}
+	assign := func(indexVersion int64) bool {
+		isRebuild := in.isRebuildAssignment(key, indexVersion)
+		_, err := in.loadOrStoreTask(key.ClusterID, key.BuildID, &taskInfo{
+			state:        commonpb.IndexState_Unissued,
+			indexVersion: indexVersion,
+			isRebuild:    isRebuild,
+		})
+		assert.NoError(t, err)
+		return isRebuild
+	}
+	finish := func(state commonpb.IndexState) {
+		in.storeTaskState(context.TODO(), key.ClusterID, key.BuildID, state, "")
+		in.deleteTaskInfos(context.TODO(), []taskKey{key})
+	}
+
+	// the retries of the first build are not rebuilds, though the coordinator increases the index version
+	assert.False(t, assign(1))
+	finish(commonpb.IndexState_Retry)
+	assert.False(t, assign(2))
+	finish(commonpb.IndexState_Failed)
+	assert.False(t, assign(3))
+	finish(commonpb.IndexState_Finished)
+
+	// the assignments after the build is finished are rebuilds, their retries included
+	assert.True(t, assign(4))
+	finish(commonpb.IndexState_Retry)
+	assert.True(t, assign(5))
+	finish(commonpb.IndexState_Finished)
+	// a stale assignment is not taken as a rebuild
+	assert.False(t, in.isRebuildAssignment(key, 5))
+	assert.False(t, in.isRebuildAssignment(taskKey{ClusterID: "cluster-1", BuildID: 2}, 6))
+}
+
+func TestIndexNode_loadOrStoreTaskWaitCleanup(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.TaskDeletionWaitTimeout.Key, "100")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.TaskDeletionWaitTimeout.Key)
+	in := newTestIndexNode()
+
+	releasing := make(chan struct{})
+	released := make(chan struct{})
+	newTask := func() *taskInfo {
+		return &taskInfo{
+			state: commonpb.IndexState_InProgress,
+			onDelete: func() error {
+				<-releasing
+				return nil
+			},
+		}
+	}
+	in.loadOrStoreTask("cluster-1", 1, newTask())
+	go func() {
+		defer close(released)
+		in.deleteTasksWhere(context.TODO(), func(*taskInfo) bool { return true })
+	}()
+	assert.Eventually(t, func() bool {
+		return in.loadTaskState("cluster-1", 1) == commonpb.IndexState_IndexStateNone
+	}, time.Second, time.Millisecond)
+
+	t.Run("busy", func(t *testing.T) {
+		_, err := in.loadOrStoreTask("cluster-1", 1, newTask())
+		assert.ErrorIs(t, err, errTaskBusy)
+		assert.Equal(t, admissionRejectedBusy, in.recentAdmissionDecisions(1)[0].Outcome)
+		// the other keys are not blocked
+		_, err = in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+		assert.NoError(t, err)
+	})
+
+	t.Run("registered after cleanup", func(t *testing.T) {
+		paramtable.Get().Save(Params.IndexNodeCfg.TaskDeletionWaitTimeout.Key, "10000")
+		wg := sync.WaitGroup{}
+		errs := make([]error, 4)
+		for idx := range errs {
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				_, errs[idx] = in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+			}(idx)
+		}
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 1))
+		close(releasing)
+		wg.Wait()
+		<-released
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-1", 1))
+		assert.Len(t, in.deletingTasks, 0)
+	})
+}
+
+func TestTaskTombstones(t *testing.T) {
+	tombstones := newTaskTombstones()
+	now := time.Now()
+	for buildID := UniqueID(1); buildID <= 3; buildID++ {
+		tombstones.add(taskKey{ClusterID: "cluster-1", BuildID: buildID}, now.Add(time.Duration(buildID)*time.Second), 0, 2)
+	}
+	assert.Equal(t, 2, tombstones.len())
+	_, ok := tombstones.get(taskKey{ClusterID: "cluster-1", BuildID: 1})
+	assert.False(t, ok)
+	deletedAt, ok := tombstones.get(taskKey{ClusterID: "cluster-1", BuildID: 3})
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(3*time.Second), deletedAt)
+
+	// deleting again refreshes the tombstone, so that it's evicted last
+	tombstones.add(taskKey{ClusterID: "cluster-1", BuildID: 2}, now.Add(4*time.Second), 0, 2)
+	tombstones.add(taskKey{ClusterID: "cluster-1", BuildID: 4}, now.Add(5*time.Second), 0, 2)
+	_, ok = tombstones.get(taskKey{ClusterID: "cluster-1", BuildID: 3})
+	assert.False(t, ok)
+	deletedAt, ok = tombstones.get(taskKey{ClusterID: "cluster-1", BuildID: 2})
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(4*time.Second), deletedAt)
+
+	// shrinking the capacity evicts the oldest ones
+	tombstones.add(taskKey{ClusterID: "cluster-1", BuildID: 5}, now.Add(6*time.Second), 0, 1)
+	assert.Equal(t, 1, tombstones.len())
+	tombstones.add(taskKey{ClusterID: "cluster-1", BuildID: 6}, now.Add(7*time.Second), 0, 0)
+	assert.Equal(t, 0, tombstones.len())
+
+	// the highest finished index version is kept when the task is deleted again
+	tombstones.add(taskKey{ClusterID: "cluster-1", BuildID: 7}, now, 3, 2)
+	tombstones.add(taskKey{ClusterID: "cluster-1", BuildID: 7}, now, 0, 2)
+	assert.Equal(t, int64(3), tombstones.finishedIndexVersion(taskKey{ClusterID: "cluster-1", BuildID: 7}))
+	tombstones.add(taskKey{ClusterID: "cluster-1", BuildID: 7}, now, 5, 2)
+	assert.Equal(t, int64(5), tombstones.finishedIndexVersion(taskKey{ClusterID: "cluster-1", BuildID: 7}))
+	assert.Equal(t, int64(0), tombstones.finishedIndexVersion(taskKey{ClusterID: "cluster-1", BuildID: 8}))
+}
+
+func TestIndexNode_taskTombstones(t *testing.T) {
+	in := newTestIndexNode()
+	paramtable.Get().Save(Params.IndexNodeCfg.TaskTombstoneCapacity.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.TaskTombstoneCapacity.Key)
+
+	for buildID := UniqueID(1); buildID <= 3; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+	}
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 1}})
+	// late update of a deleted task is ignored
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 1))
+
+	in.stateLock.Lock()
+	_, ok := in.tombstones.get(taskKey{ClusterID: "cluster-1", BuildID: 1})
+	in.stateLock.Unlock()
+	assert.True(t, ok)
+
+	in.deleteAllTasks()
+	in.stateLock.Lock()
+	defer in.stateLock.Unlock()
+	assert.Equal(t, 2, in.tombstones.len())
+	_, ok = in.tombstones.get(taskKey{ClusterID: "cluster-1", BuildID: 1})
+	assert.False(t, ok)
+}
+
+func TestIndexNode_waitForTaskTerminal(t *testing.T) {
+	in := newTestIndexNode()
+
+	t.Run("finish", func(t *testing.T) {
+		in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+			time.Sleep(50 * time.Millisecond)
+			in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+		}()
+		state, err := in.waitForTaskTerminal(context.TODO(), "cluster-1", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, commonpb.IndexState_Finished, state)
+
+		// the task in a terminal state returns at once
+		state, err = in.waitForTaskTerminal(context.TODO(), "cluster-1", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, commonpb.IndexState_Finished, state)
+	})
+
+	t.Run("cancel context", func(t *testing.T) {
+		in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+		ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+		defer cancel()
+		_, err := in.waitForTaskTerminal(ctx, "cluster-1", 2)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("missing task", func(t *testing.T) {
+		_, err := in.waitForTaskTerminal(context.TODO(), "cluster-1", 3)
+		assert.ErrorIs(t, err, merr.ErrParameterInvalid)
+
+		// the task deleted while waiting
+		in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 4}})
+		}()
+		_, err = in.waitForTaskTerminal(context.TODO(), "cluster-1", 4)
+		assert.ErrorIs(t, err, merr.ErrParameterInvalid)
+	})
+}
+
+func TestIndexNode_drainCluster(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.GracefulStopTimeout.Key, "10")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.GracefulStopTimeout.Key)
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Finished})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-3", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	drain := func(clusterID string) <-chan error {
+		done := make(chan error, 1)
+		numTickers := clock.numTickers()
+		go func() {
+			done <- in.drainCluster(context.TODO(), clusterID)
+		}()
+		assert.Eventually(t, func() bool {
+			return clock.numTickers() > numTickers
+		}, time.Second, 10*time.Millisecond)
+		return done
+	}
+
+	t.Run("done in time", func(t *testing.T) {
+		done := drain("cluster-1")
+		// the draining cluster doesn't accept new tasks, other clusters are not affected
+		_, err := in.loadOrStoreTask("cluster-1", 5, &taskInfo{state: commonpb.IndexState_Unissued})
+		assert.ErrorIs(t, err, merr.ErrServiceUnavailable)
+		_, err = in.loadOrStoreTask("cluster-3", 6, &taskInfo{state: commonpb.IndexState_Unissued})
+		assert.NoError(t, err)
+
+		clock.Advance(time.Second)
+		select {
+		case <-done:
+			t.Fatal("drainCluster returns with a task in progress")
+		case <-time.After(50 * time.Millisecond):
+		}
+		in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+		clock.Advance(time.Second)
+		assert.NoError(t, <-done)
+
+		assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 1))
+		assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 2))
+		assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-2", 3))
+		// the drained cluster accepts new tasks again
+		_, err = in.loadOrStoreTask("cluster-1", 5, &taskInfo{state: commonpb.IndexState_Unissued})
+		assert.NoError(t, err)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		done := drain("cluster-2")
+		clock.Advance(10 * time.Second)
+		assert.Error(t, <-done)
+		// the tasks are kept
+		assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-2", 3))
+		_, err := in.loadOrStoreTask("cluster-2", 7, &taskInfo{state: commonpb.IndexState_Unissued})
+		assert.NoError(t, err)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		err := in.drainCluster(ctx, "cluster-3")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-3", 4))
+	})
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestIndexNode_cancelledTaskRatio(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Equal(t, 0.0, in.cancelledTaskRatio("cluster-ratio"))
+
+	for buildID := UniqueID(1); buildID <= 5; buildID++ {
+		in.loadOrStoreTask("cluster-ratio", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+	}
+	in.loadOrStoreTask("cluster-other", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.storeTaskState(context.TODO(), "cluster-ratio", 1, commonpb.IndexState_Finished, "")
+	in.storeTaskState(context.TODO(), "cluster-ratio", 2, commonpb.IndexState_Failed, "build failed")
+	assert.True(t, in.cancelTask("cluster-ratio", 3, "dropped"))
+	in.storeTaskState(context.TODO(), "cluster-ratio", 3, commonpb.IndexState_Retry, "context canceled")
+	// a transition between terminal states is counted once
+	in.storeTaskState(context.TODO(), "cluster-ratio", 2, commonpb.IndexState_Retry, "build failed")
+	in.storeTaskState(context.TODO(), "cluster-ratio", 4, commonpb.IndexState_Finished, "")
+	in.storeTaskState(context.TODO(), "cluster-other", 1, commonpb.IndexState_Finished, "")
+
+	assert.Equal(t, 0.25, in.cancelledTaskRatio("cluster-ratio"))
+	assert.Equal(t, 0.0, in.cancelledTaskRatio("cluster-other"))
+	nodeID := strconv.FormatInt(paramtable.GetNodeID(), 10)
+	assert.Equal(t, 0.25, testutil.ToFloat64(metrics.IndexNodeCancelledTaskRatio.WithLabelValues(nodeID, "cluster-ratio")))
+	assert.NoError(t, in.checkInvariants())
+
+	// the counts are forgotten once the cluster has no task left
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-other", BuildID: 1}})
+	assert.Equal(t, 0.25, in.cancelledTaskRatio("cluster-ratio"))
+	in.stateLock.Lock()
+	assert.NotContains(t, in.terminalTaskCounts, "cluster-other")
+	in.stateLock.Unlock()
+	in.deleteAllTasks()
+	assert.Equal(t, 0.0, in.cancelledTaskRatio("cluster-ratio"))
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestIndexNode_clusterFailureRate(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	assert.Equal(t, 0.0, in.clusterFailureRate("cluster-1", 10*time.Minute))
+
+	finish := func(clusterID string, buildID UniqueID, state commonpb.IndexState) {
+		in.loadOrStoreTask(clusterID, buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+		in.storeTaskState(context.TODO(), clusterID, buildID, state, "")
+	}
+	// the outcomes out of the window
+	finish("cluster-1", 1, commonpb.IndexState_Failed)
+	finish("cluster-1", 2, commonpb.IndexState_Failed)
+	clock.Advance(20 * time.Minute)
+
+	finish("cluster-1", 3, commonpb.IndexState_Finished)
+	finish("cluster-1", 4, commonpb.IndexState_Failed)
+	finish("cluster-1", 5, commonpb.IndexState_Retry)
+	finish("cluster-1", 6, commonpb.IndexState_Finished)
+	finish("cluster-1", 7, commonpb.IndexState_Finished)
+	// the cancelled task is not counted
+	in.loadOrStoreTask("cluster-1", 8, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.cancelTask("cluster-1", 8, "dropped")
+	in.storeTaskState(context.TODO(), "cluster-1", 8, commonpb.IndexState_Retry, "")
+	finish("cluster-2", 1, commonpb.IndexState_Finished)
+	clock.Advance(time.Minute)
+
+	assert.InDelta(t, 0.4, in.clusterFailureRate("cluster-1", 10*time.Minute), 1e-9)
+	assert.InDelta(t, 4.0/7, in.clusterFailureRate("cluster-1", time.Hour), 1e-9)
+	assert.Equal(t, 0.0, in.clusterFailureRate("cluster-1", 30*time.Second))
+	assert.Equal(t, 0.0, in.clusterFailureRate("cluster-2", 10*time.Minute))
+	assert.NoError(t, in.checkInvariants())
+
+	// the outcomes are forgotten once the cluster has no task left
+	for buildID := UniqueID(1); buildID <= 7; buildID++ {
+		in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: buildID}})
+	}
+	assert.InDelta(t, 0.4, in.clusterFailureRate("cluster-1", 10*time.Minute), 1e-9)
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 8}})
+	assert.Equal(t, 0.0, in.clusterFailureRate("cluster-1", time.Hour))
+	in.stateLock.Lock()
+	assert.NotContains(t, in.recentOutcomes, "cluster-1")
+	assert.Contains(t, in.recentOutcomes, "cluster-2")
+	in.stateLock.Unlock()
+	in.deleteAllTasks()
+	assert.Len(t, in.recentOutcomes, 0)
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestTaskOutcomesBounded(t *testing.T) {
+	outcomes := &taskOutcomes{}
+	for n := 0; n < maxRecentOutcomesPerCluster+10; n++ {
+		outcomes.add(taskOutcome{failed: n < 10})
+	}
+	assert.Len(t, outcomes.outcomes, maxRecentOutcomesPerCluster)
+	for _, outcome := range outcomes.outcomes {
+		assert.False(t, outcome.failed)
+	}
+}
+
+func TestIndexNode_lastErrorPerCluster(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	assert.Len(t, in.lastErrorPerCluster(), 0)
+
+	for buildID := UniqueID(1); buildID <= 5; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+	}
+	in.loadOrStoreTask("cluster-2", 6, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-3", 7, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	start := clock.Now()
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Failed, "out of memory")
+	in.storeTaskState(context.TODO(), "cluster-2", 6, commonpb.IndexState_Failed, "no such key")
+	clock.Advance(time.Minute)
+	in.failIndexTask(context.TODO(), "cluster-1", 2, "invalid params", nil)
+	// the tasks retried, finished or cancelled are not taken as errors
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Retry, "node busy")
+	in.storeTaskState(context.TODO(), "cluster-1", 4, commonpb.IndexState_Finished, "")
+	in.cancelTask("cluster-1", 5, "dropped")
+	in.storeTaskState(context.TODO(), "cluster-1", 5, commonpb.IndexState_Failed, "context canceled")
+	in.storeTaskState(context.TODO(), "cluster-3", 7, commonpb.IndexState_Finished, "")
+
+	expected := map[string]ClusterError{
+		"cluster-1": {BuildID: 2, FailReason: "invalid params", Time: start.Add(time.Minute)},
+		"cluster-2": {BuildID: 6, FailReason: "no such key", Time: start},
+	}
+	assert.Equal(t, expected, in.lastErrorPerCluster())
+
+	// the last error is kept after the failed task is deleted
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 2}})
+	assert.Equal(t, expected, in.lastErrorPerCluster())
+	// the last error is forgotten once the cluster has no task left
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-2", BuildID: 6}})
+	delete(expected, "cluster-2")
+	assert.Equal(t, expected, in.lastErrorPerCluster())
+	in.deleteAllTasks()
+	assert.Len(t, in.lastErrorPerCluster(), 0)
+}
+
+func TestIndexNode_quarantinedBuilds(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.QuarantineFailureThreshold.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.QuarantineFailureThreshold.Key)
+
+	in := newTestIndexNode()
+	fail := func(buildID UniqueID, state commonpb.IndexState, failReason string) error {
+		_, err := in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+		if err != nil {
+			return err
+		}
+		in.storeTaskState(context.TODO(), "cluster-1", buildID, state, failReason)
+		in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: buildID}})
+		return nil
+	}
+
+	// different failures don't add up
+	assert.NoError(t, fail(1, commonpb.IndexState_Retry, "load data failed"))
+	assert.NoError(t, fail(1, commonpb.IndexState_Retry, "build index failed"))
+	assert.Empty(t, in.quarantinedBuilds())
+
+	// the same failure repeats, only the truncated reason counts
+	reason := strings.Repeat("x", failureSignatureReasonLength)
+	assert.NoError(t, fail(1, commonpb.IndexState_Failed, reason+"1"))
+	assert.NoError(t, fail(1, commonpb.IndexState_Retry, reason+"2"))
+	assert.Equal(t, []UniqueID{1}, in.quarantinedBuilds())
+	err := fail(1, commonpb.IndexState_Retry, "")
+	assert.ErrorIs(t, err, errBuildQuarantined)
+
+	// a finished build is forgiven
+	assert.NoError(t, fail(2, commonpb.IndexState_Retry, "build index failed"))
+	assert.NoError(t, fail(2, commonpb.IndexState_Finished, ""))
+	assert.NoError(t, fail(2, commonpb.IndexState_Retry, "build index failed"))
+	assert.Equal(t, []UniqueID{1}, in.quarantinedBuilds())
+
+	// the quarantine is lifted after the cool-down
+	paramtable.Get().Save(Params.IndexNodeCfg.QuarantineCooldown.Key, "0")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.QuarantineCooldown.Key)
+	assert.NoError(t, fail(3, commonpb.IndexState_Retry, "build index failed"))
+	assert.NoError(t, fail(3, commonpb.IndexState_Retry, "build index failed"))
+	assert.NotContains(t, in.quarantinedBuilds(), UniqueID(3))
+	assert.NoError(t, fail(3, commonpb.IndexState_Retry, "build index failed"))
+}
+
+func TestIndexNode_pruneBuildFailures(t *testing.T) {
+	paramtable.Init()
+	paramtable.Get().Save(Params.IndexNodeCfg.QuarantineFailureThreshold.Key, "2")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.QuarantineFailureThreshold.Key)
+	paramtable.Get().Save(Params.IndexNodeCfg.QuarantineCooldown.Key, "60")
+	defer paramtable.Get().Reset(Params.IndexNodeCfg.QuarantineCooldown.Key)
+
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	fail := func(buildID UniqueID) {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+		in.storeTaskState(context.TODO(), "cluster-1", buildID, commonpb.IndexState_Retry, "build index failed")
+		in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: buildID}})
+	}
+
+	fail(1)
+	fail(2)
+	fail(2)
+	assert.Equal(t, []UniqueID{2}, in.quarantinedBuilds())
+	// the failures apart longer than the cool-down don't add up
+	clock.Advance(61 * time.Second)
+	fail(1)
+	assert.Empty(t, in.quarantinedBuilds())
+
+	// the builds which don't fail again are forgotten as new builds fail
+	clock.Advance(61 * time.Second)
+	fail(3)
+	in.stateLock.Lock()
+	assert.Equal(t, []UniqueID{3}, maps.Keys(in.buildFailures))
+	in.stateLock.Unlock()
+}
+
+func TestIndexFileKeys(t *testing.T) {
+	assert.Nil(t, newIndexFileKeys(nil).keys())
+	assert.Equal(t, 0, newIndexFileKeys([]string{}).len())
+
+	keys := []string{
+		"files/index_files/1/2/3/4/HNSW_1",
+		"files/index_files/1/2/3/4/HNSW_2",
+		"files/index_files/1/2/3/4/index_type",
+	}
+	fileKeys := newIndexFileKeys(keys)
+	assert.Equal(t, "files/index_files/1/2/3/4/", fileKeys.prefix)
+	assert.Equal(t, []string{"HNSW_1", "HNSW_2", "index_type"}, fileKeys.suffixes)
+	assert.Equal(t, keys, fileKeys.keys())
+	assert.Equal(t, 3, fileKeys.len())
+
+	// the returned keys are owned by the caller
+	got := fileKeys.keys()
+	got[0] = "changed"
+	assert.Equal(t, keys, fileKeys.keys())
+
+	// a single key, keys without a common prefix, and a key being the prefix of another
+	assert.Equal(t, []string{"a/b"}, newIndexFileKeys([]string{"a/b"}).keys())
+	assert.Equal(t, []string{"a", "b"}, newIndexFileKeys([]string{"a", "b"}).keys())
+	assert.Equal(t, []string{"a/b", "a/b/c", ""}, newIndexFileKeys([]string{"a/b", "a/b/c", ""}).keys())
+}
+
+func TestIndexFileKeysSample(t *testing.T) {
+	keys := []string{"files/1/a", "files/1/b", "files/1/c"}
+	fileKeys := newIndexFileKeys(keys)
+	for _, limit := range []int{0, -1, 3, 4} {
+		assert.Equal(t, keys, fileKeys.sample(limit))
+	}
+
+	assert.Equal(t, []string{"files/1/a", "files/1/b"}, fileKeys.sample(2))
+	// sampling doesn't drop the retained keys
+	assert.Equal(t, keys, fileKeys.keys())
+	assert.Equal(t, 3, fileKeys.len())
+}
+
+func TestDedupFileKeys(t *testing.T) {
+	cases := []struct {
+		description string
+		keys        []string
+		expected    []string
+		dupes       int
+	}{
+		{"no duplicates", []string{"a", "b", "c"}, []string{"a", "b", "c"}, 0},
+		{"duplicates", []string{"a", "b", "a", "c", "b", "a"}, []string{"a", "b", "c"}, 3},
+		{"nil", nil, nil, 0},
+	}
+	for _, test := range cases {
+		t.Run(test.description, func(t *testing.T) {
+			deduped, dupes := dedupFileKeys(test.keys)
+			assert.Equal(t, test.expected, deduped)
+			assert.Equal(t, test.dupes, dupes)
+		})
+	}
+}
+
+func TestIndexNode_taskFileKeysByVersion(t *testing.T) {
+	in := newTestIndexNode()
+	_, ok := in.taskFileKeys("cluster-1", 1, 4)
+	assert.False(t, ok)
+	assert.Nil(t, in.taskFileKeysOfAllVersions("cluster-1", 1))
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.Empty(t, in.taskFileKeysOfAllVersions("cluster-1", 1))
+	err := in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"files/v4/a", "files/v4/b"}, 10, &indexpb.JobInfo{}, 4)
+	assert.NoError(t, err)
+	// the keys of the same version are replaced
+	err = in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"files/v4/c"}, 10, &indexpb.JobInfo{}, 4)
+	assert.NoError(t, err)
+	// the keys of another version are stored side by side
+	err = in.finishIndexTask(context.TODO(), "cluster-1", 1, IndexResult{FileKeys: []string{"files/v5/a"}, CurrentIndexVersion: 5})
+	assert.NoError(t, err)
+
+	keys, ok := in.taskFileKeys("cluster-1", 1, 4)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"files/v4/c"}, keys)
+	keys, ok = in.taskFileKeys("cluster-1", 1, 5)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"files/v5/a"}, keys)
+	_, ok = in.taskFileKeys("cluster-1", 1, 3)
+	assert.False(t, ok)
+	assert.Equal(t, map[int32][]string{4: {"files/v4/c"}, 5: {"files/v5/a"}}, in.taskFileKeysOfAllVersions("cluster-1", 1))
+	// the snapshot reports the keys of the current version
+	assert.Equal(t, []string{"files/v5/a"}, in.indexTaskSnapshots()[0].FileKeys)
+	assert.Len(t, in.tasksWithFilePrefix("files/v4/"), 1)
+
+	// storing the keys of a retained version again moves it back to the current one
+	err = in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"files/v4/d"}, 10, &indexpb.JobInfo{}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int32][]string{4: {"files/v4/d"}, 5: {"files/v5/a"}}, in.taskFileKeysOfAllVersions("cluster-1", 1))
+	assert.Equal(t, []string{"files/v4/d"}, in.indexTaskSnapshots()[0].FileKeys)
+}
+
+func BenchmarkIndexFileKeys(b *testing.B) {
+	keys := make([]string, 0, 500)
+	for i := 0; i < 500; i++ {
+		keys = append(keys, fmt.Sprintf("files/index_files/448901234567890123/448901234567890124/448901234567890125/448901234567890126/HNSW_%d", i))
+	}
+	rawBytes := 0
+	for _, key := range keys {
+		rawBytes += len(key)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var fileKeys indexFileKeys
+	for n := 0; n < b.N; n++ {
+		fileKeys = newIndexFileKeys(keys)
+	}
+	b.StopTimer()
+
+	storedBytes := len(fileKeys.prefix)
+	for _, suffix := range fileKeys.suffixes {
+		storedBytes += len(suffix)
+	}
+	b.ReportMetric(float64(rawBytes), "raw-bytes/task")
+	b.ReportMetric(float64(storedBytes), "stored-bytes/task")
+}
+
+func TestIndexNode_indexTaskForSegment(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Finished, segmentIDs: []int64{100, 101}})
+	clock.Advance(time.Minute)
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress, segmentIDs: []int64{101, 102}})
+	clock.Advance(time.Minute)
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress, segmentIDs: []int64{102}})
+
+	// the tasks are deleted one after another, the segments fall back to the remaining tasks covering them
+	cases := []struct {
+		description string
+		deleted     []taskKey
+		expected    map[int64]taskKey
+	}{
+		{"overlapping segments are indexed to the task registered last", nil, map[int64]taskKey{
+			100: {ClusterID: "cluster-1", BuildID: 1},
+			101: {ClusterID: "cluster-1", BuildID: 2},
+			102: {ClusterID: "cluster-2", BuildID: 3},
+		}},
+		{"last task deleted", []taskKey{{ClusterID: "cluster-2", BuildID: 3}}, map[int64]taskKey{
+			100: {ClusterID: "cluster-1", BuildID: 1},
+			101: {ClusterID: "cluster-1", BuildID: 2},
+			102: {ClusterID: "cluster-1", BuildID: 2},
+		}},
+		{"overlapping task deleted", []taskKey{{ClusterID: "cluster-1", BuildID: 2}}, map[int64]taskKey{
+			100: {ClusterID: "cluster-1", BuildID: 1},
+			101: {ClusterID: "cluster-1", BuildID: 1},
+		}},
+		{"all tasks deleted", []taskKey{{ClusterID: "cluster-1", BuildID: 1}}, map[int64]taskKey{}},
+	}
+	for _, test := range cases {
+		t.Run(test.description, func(t *testing.T) {
+			in.deleteTaskInfos(context.TODO(), test.deleted)
+			for segmentID := int64(100); segmentID <= 103; segmentID++ {
+				expected, expectedOk := test.expected[segmentID]
+				key, ok := in.indexTaskForSegment(segmentID)
+				assert.Equal(t, expectedOk, ok)
+				assert.Equal(t, expected, key)
+			}
+			assert.Len(t, in.segmentTasks, len(test.expected))
+			assert.NoError(t, in.checkInvariants())
+		})
+	}
+}
+
+func TestIndexNode_indexTaskSnapshots(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Empty(t, in.indexTaskSnapshots())
+
+	in.loadOrStoreTask("cluster-2", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"file"}, 10, &indexpb.JobInfo{NumRows: 1}, 1))
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Len(t, snapshots, 3)
+	assert.Equal(t, taskKey{ClusterID: "cluster-1", BuildID: 1}, snapshots[0].key())
+	assert.Equal(t, taskKey{ClusterID: "cluster-1", BuildID: 2}, snapshots[1].key())
+	assert.Equal(t, taskKey{ClusterID: "cluster-2", BuildID: 1}, snapshots[2].key())
+	assert.Equal(t, []string{"file"}, snapshots[0].FileKeys)
+	assert.Equal(t, uint64(10), snapshots[0].SerializedSize)
+	assert.Equal(t, int64(1), snapshots[0].Statistic.GetNumRows())
+	assert.False(t, snapshots[0].CreateTime.IsZero())
+
+	// snapshots are copies
+	snapshots[0].FileKeys[0] = "modified"
+	assert.Equal(t, []string{"file"}, in.indexTaskSnapshots()[0].FileKeys)
+}
+
+func TestIndexNode_foreachTaskSnapshot(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	// the retained snapshots are read while the tasks are updated, which is race-free
+	retained := make([]IndexTaskSnapshot, 0)
+	in.foreachTaskSnapshot(func(snapshot IndexTaskSnapshot) {
+		retained = append(retained, snapshot)
+		// the index node can be called from the callback
+		in.loadTaskState(snapshot.ClusterID, snapshot.BuildID)
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 100; n++ {
+			in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+			in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_InProgress, "")
+		}
+		in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	}()
+	for n := 0; n < 100; n++ {
+		for _, snapshot := range retained {
+			assert.Equal(t, commonpb.IndexState_InProgress, snapshot.State)
+		}
+	}
+	<-done
+
+	assert.Len(t, retained, 2)
+	assert.Equal(t, UniqueID(1), retained[0].BuildID)
+	assert.Equal(t, UniqueID(2), retained[1].BuildID)
+}
+
+func snapshotBuildIDs(snapshots []IndexTaskSnapshot) []UniqueID {
+	buildIDs := make([]UniqueID, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		buildIDs = append(buildIDs, snapshot.BuildID)
+	}
+	return buildIDs
+}
+
+func TestIndexNode_indexTasksByCluster(t *testing.T) {
+	in := newTestIndexNode()
+	assert.Empty(t, in.indexTasksByCluster())
+
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Finished})
+	in.loadOrStoreTask("cluster-2", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-3", 5, &taskInfo{state: commonpb.IndexState_Failed})
+
+	groups := in.indexTasksByCluster()
+	assert.Len(t, groups, 3)
+	assert.Equal(t, []UniqueID{2, 4}, snapshotBuildIDs(groups["cluster-1"]))
+	assert.Equal(t, []UniqueID{1, 3}, snapshotBuildIDs(groups["cluster-2"]))
+	assert.Equal(t, []UniqueID{5}, snapshotBuildIDs(groups["cluster-3"]))
+	assert.Equal(t, commonpb.IndexState_Unissued, groups["cluster-2"][0].State)
+}
+
+func TestIndexNode_tasksChangedSince(t *testing.T) {
+	in := newTestIndexNode()
+	changed, gen := in.tasksChangedSince(0)
+	assert.Empty(t, changed)
+	assert.Equal(t, uint64(0), gen)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_Unissued})
+	changed, gen = in.tasksChangedSince(0)
+	assert.Len(t, changed, 3)
+
+	in.storeTaskState(context.TODO(), "cluster-2", 3, commonpb.IndexState_InProgress, "")
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+	// the mutations other than state changes are not counted
+	in.storeTaskWorker("cluster-1", 2, "index-build-worker-0")
+	changed, next := in.tasksChangedSince(gen)
+	assert.Len(t, changed, 2)
+	assert.Equal(t, UniqueID(1), changed[0].BuildID)
+	assert.Equal(t, commonpb.IndexState_InProgress, changed[0].State)
+	assert.Equal(t, UniqueID(3), changed[1].BuildID)
+	assert.Greater(t, next, gen)
+
+	changed, gen = in.tasksChangedSince(next)
+	assert.Empty(t, changed)
+	assert.Equal(t, next, gen)
+
+	err := in.finishIndexTask(context.TODO(), "cluster-1", 1, IndexResult{FileKeys: []string{"file1"}})
+	assert.NoError(t, err)
+	changed, _ = in.tasksChangedSince(gen)
+	assert.Len(t, changed, 1)
+	assert.Equal(t, commonpb.IndexState_Finished, changed[0].State)
+}
+
+func TestDiffTaskSnapshots(t *testing.T) {
+	newSnapshot := func(clusterID string, buildID UniqueID, state commonpb.IndexState) IndexTaskSnapshot {
+		return IndexTaskSnapshot{ClusterID: clusterID, BuildID: buildID, State: state}
+	}
+	before := []IndexTaskSnapshot{
+		newSnapshot("cluster-1", 1, commonpb.IndexState_InProgress),
+		newSnapshot("cluster-1", 2, commonpb.IndexState_InProgress),
+		newSnapshot("cluster-2", 1, commonpb.IndexState_Finished),
+		newSnapshot("cluster-2", 2, commonpb.IndexState_InProgress),
+	}
+	after := []IndexTaskSnapshot{
+		newSnapshot("cluster-3", 1, commonpb.IndexState_InProgress),
+		newSnapshot("cluster-2", 2, commonpb.IndexState_Failed),
+		newSnapshot("cluster-1", 2, commonpb.IndexState_InProgress),
+		newSnapshot("cluster-1", 1, commonpb.IndexState_Finished),
+		newSnapshot("cluster-1", 3, commonpb.IndexState_InProgress),
+	}
+
+	diff := DiffTaskSnapshots(before, after)
+	assert.Equal(t, []IndexTaskSnapshot{
+		newSnapshot("cluster-1", 3, commonpb.IndexState_InProgress),
+		newSnapshot("cluster-3", 1, commonpb.IndexState_InProgress),
+	}, diff.Added)
+	assert.Equal(t, []IndexTaskSnapshot{
+		newSnapshot("cluster-2", 1, commonpb.IndexState_Finished),
+	}, diff.Removed)
+	assert.Equal(t, []TaskStateChange{
+		{Before: newSnapshot("cluster-1", 1, commonpb.IndexState_InProgress), After: newSnapshot("cluster-1", 1, commonpb.IndexState_Finished)},
+		{Before: newSnapshot("cluster-2", 2, commonpb.IndexState_InProgress), After: newSnapshot("cluster-2", 2, commonpb.IndexState_Failed)},
+	}, diff.StateChanged)
+
+	diff = DiffTaskSnapshots(after, after)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.StateChanged)
+}
+
+func TestIndexNode_streamIndexTasks(t *testing.T) {
+	in := newTestIndexNode()
+	for buildID := UniqueID(1); buildID <= 5; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+	}
+
+	batches := make([][]UniqueID, 0)
+	in.streamIndexTasks(2, func(snapshots []IndexTaskSnapshot) bool {
+		batches = append(batches, snapshotBuildIDs(snapshots))
+		return true
+	})
+	assert.Equal(t, [][]UniqueID{{1, 2}, {3, 4}, {5}}, batches)
+
+	t.Run("stop early", func(t *testing.T) {
+		calls := 0
+		in.streamIndexTasks(2, func(snapshots []IndexTaskSnapshot) bool {
+			calls++
+			return false
+		})
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("tasks changed between batches", func(t *testing.T) {
+		visited := make([]UniqueID, 0)
+		in.streamIndexTasks(2, func(snapshots []IndexTaskSnapshot) bool {
+			for _, snapshot := range snapshots {
+				visited = append(visited, snapshot.BuildID)
+			}
+			if len(visited) == 2 {
+				in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 3}})
+				in.loadOrStoreTask("cluster-1", 6, &taskInfo{state: commonpb.IndexState_InProgress})
+			}
+			return true
+		})
+		assert.Equal(t, []UniqueID{1, 2, 4, 5}, visited)
+	})
+}
+
+func TestIndexNode_latestFinishedTask(t *testing.T) {
+	in := newTestIndexNode()
+	for buildID := UniqueID(1); buildID <= 3; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+	}
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	_, ok := in.latestFinishedTask("cluster-1")
+	assert.False(t, ok)
+
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Finished, "")
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Failed, "failed")
+	in.storeTaskState(context.TODO(), "cluster-2", 4, commonpb.IndexState_Finished, "")
+
+	snapshot, ok := in.latestFinishedTask("cluster-1")
+	assert.True(t, ok)
+	assert.Equal(t, UniqueID(2), snapshot.BuildID)
+	snapshot, ok = in.latestFinishedTask("cluster-2")
+	assert.True(t, ok)
+	assert.Equal(t, UniqueID(4), snapshot.BuildID)
+
+	// deleting the cached task falls back to the previous finished one
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 2}})
+	snapshot, ok = in.latestFinishedTask("cluster-1")
+	assert.True(t, ok)
+	assert.Equal(t, UniqueID(1), snapshot.BuildID)
+
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 1}})
+	_, ok = in.latestFinishedTask("cluster-1")
+	assert.False(t, ok)
+
+	in.deleteAllTasks()
+	_, ok = in.latestFinishedTask("cluster-2")
+	assert.False(t, ok)
+}
+
+func TestIndexNode_indexTasksLargerThan(t *testing.T) {
+	in := newTestIndexNode()
+	sizes := map[UniqueID]uint64{1: 100, 2: 300, 3: 200, 4: 300, 5: 50}
+	for buildID, size := range sizes {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress})
+		err := in.storeIndexFilesAndStatistic("cluster-1", buildID, []string{"file"}, size, &indexpb.JobInfo{}, 1)
+		assert.NoError(t, err)
+	}
+
+	cases := []struct {
+		size     uint64
+		expected []UniqueID
+	}{
+		// ties are ordered by build ID
+		{100, []UniqueID{2, 4, 3}},
+		{300, []UniqueID{}},
+		{0, []UniqueID{2, 4, 3, 1, 5}},
+	}
+	for _, test := range cases {
+		assert.Equal(t, test.expected, snapshotBuildIDs(in.indexTasksLargerThan(test.size)))
+	}
+}
+
+func TestIndexNode_stuckNonTerminalTasks(t *testing.T) {
+	in := newTestIndexNode()
+	old := time.Now().Add(-time.Hour)
+	// queued and unknown tasks count from registration
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued, createTime: old})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_IndexStateNone, createTime: old})
+	// running tasks count from start
+	in.loadOrStoreTask("cluster-1", 4, &taskInfo{state: commonpb.IndexState_Unissued, createTime: old})
+	in.storeTaskState(context.TODO(), "cluster-1", 4, commonpb.IndexState_InProgress, "")
+	in.loadOrStoreTask("cluster-1", 5, &taskInfo{state: commonpb.IndexState_InProgress, createTime: old, startTime: old})
+	// terminal tasks are never stuck
+	in.loadOrStoreTask("cluster-1", 6, &taskInfo{state: commonpb.IndexState_Unissued, createTime: old})
+	in.storeTaskState(context.TODO(), "cluster-1", 6, commonpb.IndexState_Failed, "failed")
+
+	cases := []struct {
+		threshold time.Duration
+		expected  []UniqueID
+	}{
+		{time.Minute, []UniqueID{1, 3, 5}},
+		{2 * time.Hour, []UniqueID{}},
+		{0, []UniqueID{1, 2, 3, 4, 5}},
+	}
+	for _, test := range cases {
+		assert.Equal(t, test.expected, snapshotBuildIDs(in.stuckNonTerminalTasks(test.threshold)))
+	}
+}
+
+func TestIndexNode_stagnantTasks(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Finished, "")
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_Unissued})
+
+	clock.Advance(time.Hour)
+	// recently changed tasks
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_InProgress, "")
+	in.loadOrStoreTask("cluster-2", 5, &taskInfo{state: commonpb.IndexState_Unissued})
+	clock.Advance(time.Second)
+
+	cases := []struct {
+		threshold time.Duration
+		expected  []taskKey
+	}{
+		// the terminal task which is not reaped is stagnant as well
+		{time.Minute, []taskKey{{"cluster-1", 1}, {"cluster-1", 3}, {"cluster-2", 4}}},
+		{2 * time.Hour, []taskKey{}},
+		{0, []taskKey{{"cluster-1", 1}, {"cluster-1", 2}, {"cluster-1", 3}, {"cluster-2", 4}, {"cluster-2", 5}}},
+	}
+	for _, test := range cases {
+		keys := make([]taskKey, 0)
+		for _, snapshot := range in.stagnantTasks(test.threshold) {
+			keys = append(keys, snapshot.key())
+		}
+		assert.Equal(t, test.expected, keys)
+	}
+}
+
+func TestIndexNode_tasksSlowerThan(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	for buildID := UniqueID(1); buildID <= 5; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_Unissued})
+	}
+	// the time in queue doesn't count
+	clock.Advance(time.Hour)
+	for buildID := UniqueID(1); buildID <= 4; buildID++ {
+		in.storeTaskState(context.TODO(), "cluster-1", buildID, commonpb.IndexState_InProgress, "")
+	}
+	clock.Advance(time.Minute)
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	clock.Advance(10 * time.Minute)
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Failed, "failed")
+	clock.Advance(10 * time.Minute)
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Finished, "")
+	// the running task and the task failed before start are not counted
+	in.storeTaskState(context.TODO(), "cluster-1", 5, commonpb.IndexState_Failed, "failed")
+	clock.Advance(time.Hour)
+
+	cases := []struct {
+		threshold time.Duration
+		expected  []UniqueID
+	}{
+		{5 * time.Minute, []UniqueID{3, 2}},
+		{0, []UniqueID{3, 2, 1}},
+		{time.Hour, []UniqueID{}},
+	}
+	for _, test := range cases {
+		assert.Equal(t, test.expected, snapshotBuildIDs(in.tasksSlowerThan(test.threshold)))
+	}
+}
+
+func TestIndexNode_storeTaskWorker(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.storeTaskWorker("cluster-1", 1, "index-build-worker-0")
+	in.storeTaskWorker("cluster-1", 2, "index-build-worker-1")
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, "index-build-worker-0", snapshots[0].WorkerID)
+	assert.Equal(t, "index-build-worker-0", in.stuckNonTerminalTasks(0)[0].WorkerID)
+}
+
+func TestIndexNode_DumpTaskDetail(t *testing.T) {
+	in := newTestIndexNode()
+	_, err := in.DumpTaskDetail("cluster-1", 1)
+	assert.ErrorIs(t, err, merr.ErrParameterInvalid)
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued, segmentIDs: []int64{10}, isRebuild: true})
+	in.storeTaskWorker("cluster-1", 1, "index-build-worker-0")
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"files/0/a"}, 0, nil, 3))
+	in.setTaskUncancellable("cluster-1", 1, true)
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+	err = in.finishIndexTask(context.TODO(), "cluster-1", 1, IndexResult{
+		FileKeys:            []string{"files/1/a", "files/1/b"},
+		SerializedSize:      100,
+		Statistic:           &indexpb.JobInfo{NumRows: 10, Dim: 8, IndexParams: []*commonpb.KeyValuePair{{Key: "index_type", Value: "HNSW"}}},
+		CurrentIndexVersion: 4,
+		IndexStoreVersion:   5,
+	})
+	assert.NoError(t, err)
+
+	data, err := in.DumpTaskDetail("cluster-1", 1)
+	assert.NoError(t, err)
+	detail := IndexTaskDetail{}
+	assert.NoError(t, json.Unmarshal(data, &detail))
+
+	expected := in.indexTaskSnapshots()[0]
+	assert.Equal(t, expected.key(), detail.key())
+	assert.Equal(t, expected.State, detail.State)
+	assert.Equal(t, expected.FileKeys, detail.FileKeys)
+	assert.Equal(t, expected.NumFileKeys, detail.NumFileKeys)
+	assert.Equal(t, expected.SerializedSize, detail.SerializedSize)
+	assert.Equal(t, expected.CurrentIndexVersion, detail.CurrentIndexVersion)
+	assert.Equal(t, expected.IndexStoreVersion, detail.IndexStoreVersion)
+	assert.Equal(t, "index-build-worker-0", detail.WorkerID)
+	assert.True(t, expected.CreateTime.Equal(detail.CreateTime))
+	assert.True(t, expected.StartTime.Equal(detail.StartTime))
+	assert.True(t, expected.EndTime.Equal(detail.EndTime))
+	assert.Equal(t, int64(10), detail.Statistic.GetNumRows())
+	assert.Equal(t, "HNSW", detail.Statistic.GetIndexParams()[0].GetValue())
+	assert.Equal(t, map[int32][]string{3: {"files/0/a"}}, detail.VersionFileKeys)
+	assert.Equal(t, []int64{10}, detail.SegmentIDs)
+	assert.True(t, detail.IsRebuild)
+	assert.True(t, detail.Uncancellable)
+	assert.True(t, detail.StateUpdated)
+	assert.NotZero(t, detail.Version)
+	assert.NotZero(t, detail.Generation)
+}
+
+func TestIndexNode_statusLine(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	assert.Equal(t, "index: 0 inprogress / 0 total, mem: 0B, oldest: 0s", in.statusLine())
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_InProgress, "")
+	clock.Advance(3 * time.Minute)
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_InProgress, "")
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_Finished})
+	in.reportTaskActualMem("cluster-1", 1, 3<<30)
+	in.reportTaskActualMem("cluster-1", 2, 1<<29)
+	clock.Advance(4*time.Minute + 500*time.Millisecond)
+
+	assert.Equal(t, "index: 2 inprogress / 4 total, mem: 3.5GB, oldest: 7m0s", in.statusLine())
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := []struct {
+		bytes    uint64
+		expected string
+	}{
+		{512, "512B"},
+		{1536, "1.5KB"},
+		{4509715661, "4.2GB"},
+		{2 << 50, "2.0PB"},
+	}
+	for _, test := range cases {
+		assert.Equal(t, test.expected, formatBytes(test.bytes))
+	}
+}
+
+func TestIndexNode_statusLogLoop(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		in.statusLogLoop()
+	}()
+	assert.Eventually(t, func() bool { return clock.numTickers() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	in.loopCancel()
+	<-done
+}
+
+func TestIndexNode_reconcileFromCoordinator(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+
+	result := in.reconcileFromCoordinator(context.TODO(), []*indexpb.IndexTaskMeta{
+		{ClusterID: "cluster-1", BuildID: 1},
+		{ClusterID: "cluster-1", BuildID: 2},
+		{ClusterID: "cluster-1", BuildID: 3},
+		{ClusterID: "cluster-1", BuildID: 3},
+		{ClusterID: "", BuildID: 4},
+	})
+	assert.ElementsMatch(t, []taskKey{{ClusterID: "cluster-1", BuildID: 3}}, result.Added)
+	assert.ElementsMatch(t, []taskKey{{ClusterID: "cluster-1", BuildID: 1}, {ClusterID: "cluster-1", BuildID: 3}}, result.AlreadyPresent)
+	assert.ElementsMatch(t, []taskKey{{ClusterID: "cluster-1", BuildID: 2}}, result.Conflicting)
+
+	assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-1", 1))
+	assert.Equal(t, commonpb.IndexState_Unissued, in.loadTaskState("cluster-1", 3))
+	assert.Equal(t, commonpb.IndexState_IndexStateNone, in.loadTaskState("cluster-1", 2))
+	// placeholders are not taken as running tasks
+	assert.Len(t, in.inProgressTaskKeys(), 2)
+
+	// creating the job again replaces the placeholder
+	oldInfo, err := in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	assert.Nil(t, oldInfo)
+	assert.Equal(t, commonpb.IndexState_InProgress, in.loadTaskState("cluster-1", 3))
+	oldInfo, err = in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, err)
+	assert.NotNil(t, oldInfo)
+}
+
+func TestIndexNode_registerTerminalTask(t *testing.T) {
+	in := newTestIndexNode()
+	clock := newFakeClock()
+	in.clock = clock
+	in.reconcileFromCoordinator(context.TODO(), []*indexpb.IndexTaskMeta{{ClusterID: "cluster-1", BuildID: 2}})
+	in.loadOrStoreTask("cluster-1", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	clock.Advance(time.Minute)
+
+	in.registerTerminalTask("cluster-1", 1, commonpb.IndexState_Finished, "")
+	// the reconciled placeholder is replaced
+	in.registerTerminalTask("cluster-1", 2, commonpb.IndexState_Failed, "build failed elsewhere")
+	// the existing task is kept
+	in.registerTerminalTask("cluster-1", 3, commonpb.IndexState_Finished, "")
+	// invalid terminal tasks are skipped
+	in.registerTerminalTask("cluster-1", 4, commonpb.IndexState_InProgress, "")
+	in.registerTerminalTask("", 5, commonpb.IndexState_Finished, "")
+
+	snapshots := in.indexTaskSnapshots()
+	assert.Len(t, snapshots, 3)
+	assert.Equal(t, commonpb.IndexState_Finished, snapshots[0].State)
+	assert.Equal(t, clock.Now(), snapshots[0].CreateTime)
+	assert.Equal(t, clock.Now(), snapshots[0].StartTime)
+	assert.Equal(t, clock.Now(), snapshots[0].EndTime)
+	assert.Equal(t, commonpb.IndexState_Failed, snapshots[1].State)
+	assert.Equal(t, "build failed elsewhere", snapshots[1].FailReason)
+	assert.Equal(t, clock.Now(), snapshots[1].EndTime)
+	assert.Equal(t, commonpb.IndexState_InProgress, snapshots[2].State)
+
+	state, err := in.waitForTaskTerminal(context.TODO(), "cluster-1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, commonpb.IndexState_Failed, state)
+	assert.NoError(t, in.checkInvariants())
+}
+
+func TestIndexNode_ExportImportState(t *testing.T) {
+	in := newTestIndexNode()
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress, segmentIDs: []int64{10}, isRebuild: true})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_Unissued})
+	in.loadOrStoreTask("cluster-2", 4, &taskInfo{state: commonpb.IndexState_InProgress, segmentIDs: []int64{20}})
+	in.storeTaskWorker("cluster-1", 1, "worker-1")
+	assert.NoError(t, in.storeIndexFilesAndStatistic("cluster-1", 1, []string{"files/0/a"}, 0, nil, 3))
+	err := in.finishIndexTask(context.TODO(), "cluster-1", 1, IndexResult{
+		FileKeys:            []string{"files/1/a", "files/1/b"},
+		SerializedSize:      100,
+		Statistic:           &indexpb.JobInfo{NumRows: 10, Dim: 8},
+		CurrentIndexVersion: 4,
+		IndexStoreVersion:   5,
+	})
+	assert.NoError(t, err)
+	in.failIndexTask(context.TODO(), "cluster-1", 2, "build failed", map[string]string{"log": "oom"})
+	assert.True(t, in.cancelTask("cluster-2", 4, "dropped"))
+
+	data, err := in.ExportState()
+	assert.NoError(t, err)
+
+	successor := newTestIndexNode()
+	successor.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	assert.NoError(t, successor.ImportState(data))
+
+	before := in.indexTaskSnapshots()
+	after := successor.indexTaskSnapshots()
+	assert.Len(t, after, 4)
+	for idx := 0; idx < 2; idx++ {
+		assert.Equal(t, before[idx].key(), after[idx].key())
+		assert.Equal(t, before[idx].State, after[idx].State)
+		assert.Equal(t, before[idx].FailReason, after[idx].FailReason)
+		assert.Equal(t, before[idx].FileKeys, after[idx].FileKeys)
+		assert.Equal(t, before[idx].SerializedSize, after[idx].SerializedSize)
+		assert.Equal(t, before[idx].CurrentIndexVersion, after[idx].CurrentIndexVersion)
+		assert.Equal(t, before[idx].IndexStoreVersion, after[idx].IndexStoreVersion)
+		assert.Equal(t, before[idx].CreateTime.UnixMicro(), after[idx].CreateTime.UnixMicro())
+		assert.Equal(t, before[idx].EndTime.UnixMicro(), after[idx].EndTime.UnixMicro())
+		assert.Equal(t, before[idx].Statistic.GetNumRows(), after[idx].Statistic.GetNumRows())
+		assert.Equal(t, before[idx].WorkerID, after[idx].WorkerID)
+		assert.Equal(t, before[idx].Diagnostics, after[idx].Diagnostics)
+	}
+	successor.stateLock.Lock()
+	assert.Equal(t, []int64{10}, successor.tasks[taskKey{ClusterID: "cluster-1", BuildID: 1}].segmentIDs)
+	assert.True(t, successor.tasks[taskKey{ClusterID: "cluster-1", BuildID: 1}].isRebuild)
+	successor.stateLock.Unlock()
+	assert.Equal(t, map[int32][]string{3: {"files/0/a"}, 4: {"files/1/a", "files/1/b"}},
+		successor.taskFileKeysOfAllVersions("cluster-1", 1))
+	// the task already tracked by the successor is kept
+	assert.Equal(t, commonpb.IndexState_InProgress, after[2].State)
+	// the unfinished task is restarted as retry rather than resumed, along with its cancellation
+	assert.Equal(t, commonpb.IndexState_Retry, after[3].State)
+	assert.Equal(t, importedUnfinishedReason, after[3].FailReason)
+	assert.True(t, after[3].Cancelled)
+	assert.Equal(t, "dropped", after[3].CancelReason)
+	assert.False(t, after[3].EndTime.IsZero())
+
+	// the derived state is rebuilt and the tasks can be cancelled
+	assert.Equal(t, uint64(100), successor.clusterSerializedSize("cluster-1"))
+	assert.Equal(t, 1, successor.retainedFailedTasks("cluster-1"))
+	latest, ok := successor.latestFinishedTask("cluster-1")
+	assert.True(t, ok)
+	assert.Equal(t, UniqueID(1), latest.BuildID)
+	key, ok := successor.indexTaskForSegment(20)
+	assert.True(t, ok)
+	assert.Equal(t, taskKey{ClusterID: "cluster-2", BuildID: 4}, key)
+	// no job is behind the imported tasks
+	assert.False(t, successor.canCancel("cluster-2", 4))
+	assert.Equal(t, []taskKey{{ClusterID: "cluster-2", BuildID: 3}}, successor.inProgressTaskKeys())
+
+	assert.NoError(t, successor.checkInvariants())
+
+	assert.Error(t, successor.ImportState([]byte("invalid")))
+}
+
+func TestIndexNode_recomputeDerivedState(t *testing.T) {
+	in := newTestIndexNode()
+	for buildID := UniqueID(1); buildID <= 4; buildID++ {
+		in.loadOrStoreTask("cluster-1", buildID, &taskInfo{state: commonpb.IndexState_InProgress, segmentIDs: []int64{buildID * 10, 100}})
+		err := in.storeIndexFilesAndStatistic("cluster-1", buildID, []string{"file"}, 10, &indexpb.JobInfo{}, 1)
+		assert.NoError(t, err)
+	}
+	in.storeTaskState(context.TODO(), "cluster-1", 1, commonpb.IndexState_Finished, "")
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Failed, "failed")
+	in.storeTaskState(context.TODO(), "cluster-1", 3, commonpb.IndexState_Failed, "failed")
+
+	// recomputing consistent state changes nothing
+	in.recomputeDerivedState()
+	assert.Equal(t, uint64(40), in.clusterSerializedSize("cluster-1"))
+	assert.Equal(t, 2, in.retainedFailedTasks("cluster-1"))
+
+	in.stateLock.Lock()
+	in.clusterSerializedSizes["cluster-1"] = 5
+	in.clusterSerializedSizes["cluster-2"] = 100
+	in.clusterFailedTasks["cluster-1"] = nil
+	delete(in.buildClusters, 4)
+	delete(in.segmentTasks, 10)
+	in.segmentTasks[20] = taskKey{ClusterID: "cluster-1", BuildID: 3}
+	in.segmentTasks[50] = taskKey{ClusterID: "cluster-1", BuildID: 5}
+	in.segmentTasks[100] = taskKey{ClusterID: "cluster-1", BuildID: 2}
+	in.clusterTaskCounts["cluster-1"] = 1
+	in.clusterTaskCounts["cluster-2"] = 3
+	in.latestFinished["cluster-1"] = taskKey{ClusterID: "cluster-1", BuildID: 2}
+	in.stateLock.Unlock()
+
+	in.recomputeDerivedState()
+	assert.Equal(t, uint64(40), in.clusterSerializedSize("cluster-1"))
+	assert.Equal(t, uint64(0), in.clusterSerializedSize("cluster-2"))
+	assert.Equal(t, 2, in.retainedFailedTasks("cluster-1"))
+	cluster, ok := in.clusterForBuild(4)
+	assert.True(t, ok)
+	assert.Equal(t, "cluster-1", cluster)
+	snapshot, ok := in.latestFinishedTask("cluster-1")
+	assert.True(t, ok)
+	assert.Equal(t, UniqueID(1), snapshot.BuildID)
+	key, ok := in.indexTaskForSegment(10)
+	assert.True(t, ok)
+	assert.Equal(t, UniqueID(1), key.BuildID)
+	key, _ = in.indexTaskForSegment(20)
+	assert.Equal(t, UniqueID(2), key.BuildID)
+	_, ok = in.indexTaskForSegment(50)
+	assert.False(t, ok)
+	// the indexed task still covering the segment is kept
+	key, _ = in.indexTaskForSegment(100)
+	assert.Equal(t, UniqueID(2), key.BuildID)
+	assert.Equal(t, 1, in.distinctClusterCount())
+	assert.NoError(t, in.checkInvariants())
+
+	// the failed tasks are kept in the order they failed
+	in.stateLock.Lock()
+	assert.Equal(t, []taskKey{{ClusterID: "cluster-1", BuildID: 2}, {ClusterID: "cluster-1", BuildID: 3}}, in.clusterFailedTasks["cluster-1"])
+	in.stateLock.Unlock()
+}
+
+func TestIndexNode_checkInvariants(t *testing.T) {
+	in := newTestIndexNode()
+	assert.NoError(t, in.checkInvariants())
+
+	in.loadOrStoreTask("cluster-1", 1, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-1", 2, &taskInfo{state: commonpb.IndexState_InProgress})
+	in.loadOrStoreTask("cluster-2", 3, &taskInfo{state: commonpb.IndexState_InProgress})
+	err := in.finishIndexTask(context.TODO(), "cluster-1", 1, IndexResult{FileKeys: []string{"file1"}, SerializedSize: 100})
+	assert.NoError(t, err)
+	err = in.storeIndexFilesAndStatistic("cluster-2", 3, []string{"file3"}, 50, &indexpb.JobInfo{}, 1)
+	assert.NoError(t, err)
+	in.storeTaskState(context.TODO(), "cluster-1", 2, commonpb.IndexState_Failed, "build failed")
+	assert.NoError(t, in.checkInvariants())
+
+	in.deleteTaskInfos(context.TODO(), []taskKey{{ClusterID: "cluster-1", BuildID: 2}})
+	assert.NoError(t, in.checkInvariants())
+
+	// break the invariants deliberately
+	in.stateLock.Lock()
+	in.clusterSerializedSizes["cluster-1"] = 10
+	in.buildClusters[4] = "cluster-1"
+	in.clusterFailedTasks["cluster-2"] = []taskKey{{ClusterID: "cluster-2", BuildID: 3}}
+	in.stateLock.Unlock()
+	err = in.checkInvariants()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "serialized size of cluster cluster-1 is 10, expected 100")
+	assert.Contains(t, err.Error(), "build 4 is indexed to cluster cluster-1 without task")
+	assert.Contains(t, err.Error(), "isn't failed")
+
+	in.deleteAllTasks()
+	assert.NoError(t, in.checkInvariants())
+}
@@ -0,0 +1,86 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"time"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+)
+
+// maxRecentOutcomesPerCluster bounds the outcomes kept per cluster to compute the failure rate.
+const maxRecentOutcomesPerCluster = 1024
+
+type taskOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// taskOutcomes is a ring of the recent outcomes, the oldest one is overwritten once it's full.
+type taskOutcomes struct {
+	outcomes []taskOutcome
+	next     int
+}
+
+func (o *taskOutcomes) add(outcome taskOutcome) {
+	if len(o.outcomes) < maxRecentOutcomesPerCluster {
+		o.outcomes = append(o.outcomes, outcome)
+		return
+	}
+	o.outcomes[o.next] = outcome
+	o.next = (o.next + 1) % maxRecentOutcomesPerCluster
+}
+
+// recordTaskOutcome records the outcome of the task reaching a terminal state,
+// the cancelled tasks are not taken as failures nor successes. stateLock must be held by the caller.
+func (i *IndexNode) recordTaskOutcome(key taskKey, state commonpb.IndexState, cancelled bool) {
+	if cancelled {
+		return
+	}
+	outcomes, ok := i.recentOutcomes[key.ClusterID]
+	if !ok {
+		outcomes = &taskOutcomes{}
+		i.recentOutcomes[key.ClusterID] = outcomes
+	}
+	outcomes.add(taskOutcome{at: i.clock.Now(), failed: state != commonpb.IndexState_Finished})
+}
+
+// clusterFailureRate returns the ratio of the failed tasks to the tasks of the cluster
+// reaching a terminal state within the window, only the recent maxRecentOutcomesPerCluster outcomes are counted.
+func (i *IndexNode) clusterFailureRate(clusterID string, window time.Duration) float64 {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	outcomes, ok := i.recentOutcomes[clusterID]
+	if !ok {
+		return 0
+	}
+	since := i.clock.Now().Add(-window)
+	total, failed := 0, 0
+	for _, outcome := range outcomes.outcomes {
+		if outcome.at.Before(since) {
+			continue
+		}
+		total++
+		if outcome.failed {
+			failed++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(failed) / float64(total)
+}
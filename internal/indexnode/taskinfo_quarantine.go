@@ -0,0 +1,127 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.uber.org/zap"
+
+	"github.com/milvus-io/milvus/pkg/log"
+	"github.com/milvus-io/milvus/pkg/util/typeutil"
+)
+
+// the length of fail reason taken into the failure signature
+const failureSignatureReasonLength = 256
+
+var errBuildQuarantined = errors.New("index build quarantined")
+
+// buildFailure tracks the consecutive failures with the same signature of a build.
+type buildFailure struct {
+	signature        uint32
+	count            int
+	lastFailedAt     time.Time
+	quarantinedUntil time.Time
+}
+
+// expired returns whether the failure is forgotten, i.e. the quarantine is over,
+// or the build is not quarantined and hasn't failed again for the cool-down.
+func (f *buildFailure) expired(now time.Time, cooldown time.Duration) bool {
+	if !f.quarantinedUntil.IsZero() {
+		return now.After(f.quarantinedUntil)
+	}
+	return now.Sub(f.lastFailedAt) > cooldown
+}
+
+func failureSignature(failReason string) uint32 {
+	if len(failReason) > failureSignatureReasonLength {
+		failReason = failReason[:failureSignatureReasonLength]
+	}
+	return typeutil.HashString2Uint32(failReason)
+}
+
+// recordBuildFailure counts the failure of the build, and quarantines the build once the same failure
+// repeats QuarantineFailureThreshold times, each within QuarantineCooldown of the previous one.
+// stateLock must be held by the caller.
+func (i *IndexNode) recordBuildFailure(key taskKey, failReason string) {
+	threshold := Params.IndexNodeCfg.QuarantineFailureThreshold.GetAsInt()
+	if threshold <= 0 {
+		return
+	}
+	now := i.clock.Now()
+	cooldown := Params.IndexNodeCfg.QuarantineCooldown.GetAsDuration(time.Second)
+	signature := failureSignature(failReason)
+	failure, ok := i.buildFailures[key.BuildID]
+	if !ok || failure.signature != signature || failure.expired(now, cooldown) {
+		if !ok {
+			// the builds failed once and never retried are forgotten as new builds fail
+			i.pruneBuildFailures(now, cooldown)
+		}
+		failure = &buildFailure{signature: signature}
+		i.buildFailures[key.BuildID] = failure
+	}
+	failure.count++
+	failure.lastFailedAt = now
+	if failure.count >= threshold {
+		failure.quarantinedUntil = now.Add(cooldown)
+		log.Warn("IndexNode quarantine index build failing repeatedly", zap.String("clusterID", key.ClusterID),
+			zap.Int64("buildID", key.BuildID), zap.Int("failures", failure.count), zap.String("failReason", failReason),
+			zap.Time("until", failure.quarantinedUntil))
+	}
+}
+
+// checkBuildQuarantined returns errBuildQuarantined if the build is quarantined,
+// the quarantine is lifted once the cool-down elapses. stateLock must be held by the caller.
+func (i *IndexNode) checkBuildQuarantined(buildID UniqueID) error {
+	failure, ok := i.buildFailures[buildID]
+	if !ok || failure.quarantinedUntil.IsZero() {
+		return nil
+	}
+	if i.clock.Now().After(failure.quarantinedUntil) {
+		delete(i.buildFailures, buildID)
+		return nil
+	}
+	return errors.Wrapf(errBuildQuarantined, "buildID=%d, until=%s", buildID, failure.quarantinedUntil)
+}
+
+// pruneBuildFailures removes the expired failures, stateLock must be held by the caller.
+func (i *IndexNode) pruneBuildFailures(now time.Time, cooldown time.Duration) {
+	for buildID, failure := range i.buildFailures {
+		if failure.expired(now, cooldown) {
+			delete(i.buildFailures, buildID)
+		}
+	}
+}
+
+// quarantinedBuilds returns the IDs of the builds being quarantined.
+func (i *IndexNode) quarantinedBuilds() []UniqueID {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	now := i.clock.Now()
+	buildIDs := make([]UniqueID, 0)
+	for buildID, failure := range i.buildFailures {
+		if !failure.quarantinedUntil.IsZero() && now.Before(failure.quarantinedUntil) {
+			buildIDs = append(buildIDs, buildID)
+		}
+	}
+	sort.Slice(buildIDs, func(x, y int) bool {
+		return buildIDs[x] < buildIDs[y]
+	})
+	return buildIDs
+}
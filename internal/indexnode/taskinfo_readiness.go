@@ -0,0 +1,64 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"fmt"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus-proto/go-api/v2/milvuspb"
+)
+
+const taskReadinessRole = "index_tasks"
+
+// Ready reports whether the index node is ready to take index tasks, with the reason if it's not.
+// The node is not ready while the tasks reconciled after restart are not created again yet,
+// or while it has more pending tasks than ReadyMaxPendingTasks.
+func (i *IndexNode) Ready() (bool, string) {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	placeholders, pending := 0, 0
+	for _, info := range i.tasks {
+		if isReconciledPlaceholder(info) {
+			placeholders++
+		} else if isPendingTask(info) {
+			pending++
+		}
+	}
+	if placeholders > 0 {
+		return false, fmt.Sprintf("reconciliation in progress, %d tasks are not created again yet", placeholders)
+	}
+	maxPending := Params.IndexNodeCfg.ReadyMaxPendingTasks.GetAsInt()
+	if maxPending > 0 && pending > maxPending {
+		return false, fmt.Sprintf("%d pending tasks exceed the limit %d", pending, maxPending)
+	}
+	return true, ""
+}
+
+// taskReadinessState reports the readiness of the index node as a subcomponent state.
+func (i *IndexNode) taskReadinessState(nodeID int64) *milvuspb.ComponentInfo {
+	state := &milvuspb.ComponentInfo{
+		NodeID:    nodeID,
+		Role:      taskReadinessRole,
+		StateCode: commonpb.StateCode_Healthy,
+	}
+	if ready, reason := i.Ready(); !ready {
+		state.StateCode = commonpb.StateCode_Initializing
+		state.ExtraInfo = []*commonpb.KeyValuePair{{Key: "reason", Value: reason}}
+	}
+	return state
+}
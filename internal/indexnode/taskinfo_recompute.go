@@ -0,0 +1,118 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"reflect"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/pkg/log"
+)
+
+// recomputeDerivedState rebuilds the indexes and counters derived from the tasks,
+// and logs the ones which have drifted.
+func (i *IndexNode) recomputeDerivedState() {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+
+	buildClusters := make(map[UniqueID]string)
+	clusterSerializedSizes := make(map[string]uint64)
+	latestFinished := make(map[string]taskKey)
+	clusterFailedTasks := make(map[string][]taskKey)
+	segmentTasks := make(map[int64]taskKey)
+	clusterTaskCounts := make(map[string]int)
+	for key, info := range i.tasks {
+		clusterTaskCounts[key.ClusterID]++
+		// keep the registered cluster if it's still valid, as the last registered one wins on conflicts
+		if cluster, ok := buildClusters[key.BuildID]; !ok || cluster != i.buildClusters[key.BuildID] {
+			buildClusters[key.BuildID] = key.ClusterID
+		}
+		for _, segmentID := range info.segmentIDs {
+			// keep the indexed task if it still covers the segment, as the last registered one wins on conflicts
+			if indexed, ok := i.segmentTasks[segmentID]; ok {
+				if other, ok := i.tasks[indexed]; ok && containsSegment(other, segmentID) {
+					segmentTasks[segmentID] = indexed
+					continue
+				}
+			}
+			if latest, ok := segmentTasks[segmentID]; !ok || registeredLater(key, info, latest, i.tasks[latest]) {
+				segmentTasks[segmentID] = key
+			}
+		}
+		if info.serializedSize > 0 {
+			clusterSerializedSizes[key.ClusterID] += info.serializedSize
+		}
+		switch info.state {
+		case commonpb.IndexState_Finished:
+			latest, ok := latestFinished[key.ClusterID]
+			if !ok || !info.endTime.Before(i.tasks[latest].endTime) {
+				latestFinished[key.ClusterID] = key
+			}
+		case commonpb.IndexState_Failed:
+			clusterFailedTasks[key.ClusterID] = append(clusterFailedTasks[key.ClusterID], key)
+		}
+	}
+	for _, failed := range clusterFailedTasks {
+		sort.Slice(failed, func(x, y int) bool {
+			tx, ty := i.tasks[failed[x]].endTime, i.tasks[failed[y]].endTime
+			if !tx.Equal(ty) {
+				return tx.Before(ty)
+			}
+			return failed[x].BuildID < failed[y].BuildID
+		})
+	}
+
+	if !reflect.DeepEqual(buildClusters, i.buildClusters) {
+		log.Warn("IndexNode correct drifted build clusters",
+			zap.Int("before", len(i.buildClusters)), zap.Int("after", len(buildClusters)))
+	}
+	if !reflect.DeepEqual(clusterTaskCounts, i.clusterTaskCounts) {
+		log.Warn("IndexNode correct drifted cluster task counts",
+			zap.Any("before", i.clusterTaskCounts), zap.Any("after", clusterTaskCounts))
+	}
+	if !reflect.DeepEqual(segmentTasks, i.segmentTasks) {
+		log.Warn("IndexNode correct drifted segment tasks",
+			zap.Int("before", len(i.segmentTasks)), zap.Int("after", len(segmentTasks)))
+	}
+	if !reflect.DeepEqual(clusterSerializedSizes, i.clusterSerializedSizes) {
+		log.Warn("IndexNode correct drifted cluster serialized sizes",
+			zap.Any("before", i.clusterSerializedSizes), zap.Any("after", clusterSerializedSizes))
+	}
+	// the cached latest finished task may be missing after a delete, it's repopulated on read
+	for clusterID, key := range i.latestFinished {
+		if latestFinished[clusterID] != key {
+			log.Warn("IndexNode correct drifted latest finished task", zap.String("clusterID", clusterID),
+				zap.Int64("before", key.BuildID), zap.Int64("after", latestFinished[clusterID].BuildID))
+		}
+	}
+	for clusterID, failed := range clusterFailedTasks {
+		if len(i.clusterFailedTasks[clusterID]) != len(failed) {
+			log.Warn("IndexNode correct drifted retained failed tasks", zap.String("clusterID", clusterID),
+				zap.Int("before", len(i.clusterFailedTasks[clusterID])), zap.Int("after", len(failed)))
+		}
+	}
+
+	i.buildClusters = buildClusters
+	i.segmentTasks = segmentTasks
+	i.clusterTaskCounts = clusterTaskCounts
+	i.clusterSerializedSizes = clusterSerializedSizes
+	i.latestFinished = latestFinished
+	i.clusterFailedTasks = clusterFailedTasks
+}
@@ -0,0 +1,134 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/internal/proto/indexpb"
+	"github.com/milvus-io/milvus/pkg/log"
+)
+
+// ReconcileResult reports how the tasks expected by the coordinator are merged into the index node.
+type ReconcileResult struct {
+	// Added are the tasks registered as placeholders
+	Added []taskKey
+	// AlreadyPresent are the tasks the index node already knows
+	AlreadyPresent []taskKey
+	// Conflicting are the tasks whose build ID is registered under another cluster
+	Conflicting []taskKey
+}
+
+// the fail reason reported to the coordinator for the placeholder of a task not created again yet
+const placeholderRetryReason = "index task is not created again since the index node restarted"
+
+func isReconciledPlaceholder(info *taskInfo) bool {
+	return info.reconciled && info.state == commonpb.IndexState_Unissued
+}
+
+// reconcileFromCoordinator registers the tasks the coordinator expects on this node as Unissued placeholders,
+// so that state queries after restart don't return None before the jobs are created again.
+// The placeholders are reported to the coordinator as Retry by QueryJobs, as nothing builds them,
+// and the coordinator would wait forever for an Unissued task.
+func (i *IndexNode) reconcileFromCoordinator(ctx context.Context, expected []*indexpb.IndexTaskMeta) ReconcileResult {
+	result := ReconcileResult{}
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	for _, meta := range expected {
+		key := taskKey{ClusterID: meta.GetClusterID(), BuildID: meta.GetBuildID()}
+		if key.ClusterID == "" || key.BuildID <= 0 {
+			log.Ctx(ctx).Warn("IndexNode skip invalid task from coordinator",
+				zap.String("clusterID", key.ClusterID), zap.Int64("buildID", key.BuildID))
+			continue
+		}
+		if _, ok := i.tasks[key]; ok {
+			result.AlreadyPresent = append(result.AlreadyPresent, key)
+			continue
+		}
+		if cluster, ok := i.buildClusters[key.BuildID]; ok && cluster != key.ClusterID {
+			result.Conflicting = append(result.Conflicting, key)
+			continue
+		}
+		i.tasks[key] = &taskInfo{
+			key:        key,
+			state:      commonpb.IndexState_Unissued,
+			createTime: i.clock.Now(),
+			reconciled: true,
+		}
+		i.clusterTaskCounts[key.ClusterID]++
+		i.buildClusters[key.BuildID] = key.ClusterID
+		result.Added = append(result.Added, key)
+	}
+	log.Ctx(ctx).Info("IndexNode reconcile tasks from coordinator", zap.Int("expected", len(expected)),
+		zap.Int("added", len(result.Added)), zap.Int("alreadyPresent", len(result.AlreadyPresent)),
+		zap.Int("conflicting", len(result.Conflicting)))
+	return result
+}
+
+// registerTerminalTask registers the task known to be finished or failed elsewhere directly in the terminal state,
+// bypassing the state transitions. The timestamps of the task are set to now, and the task is not counted
+// in the terminal task counts and outcomes, as it's not built by this node.
+// The existing task is kept unless it's a reconciled placeholder.
+func (i *IndexNode) registerTerminalTask(clusterID string, buildID UniqueID, state commonpb.IndexState, failReason string) {
+	ctx := context.Background()
+	if clusterID == "" || buildID <= 0 || !isTerminalState(state) {
+		log.Warn("IndexNode skip registering invalid terminal task", zap.String("clusterID", clusterID),
+			zap.Int64("buildID", buildID), zap.String("state", state.String()))
+		return
+	}
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	var evicted []*taskInfo
+	defer func() {
+		if len(evicted) > 0 {
+			i.cleanupDeletedTasks(ctx, evicted)
+		}
+	}()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	oldInfo, ok := i.tasks[key]
+	if ok && !isReconciledPlaceholder(oldInfo) {
+		log.Warn("IndexNode skip registering terminal task, the task exists", zap.String("clusterID", clusterID),
+			zap.Int64("buildID", buildID), zap.String("state", oldInfo.state.String()), zap.String("newState", state.String()))
+		return
+	}
+	now := i.clock.Now()
+	info := &taskInfo{
+		state:        state,
+		failReason:   failReason,
+		createTime:   now,
+		startTime:    now,
+		endTime:      now,
+		stateUpdated: true,
+	}
+	if ok {
+		notifyTaskWaiters(oldInfo)
+	} else {
+		i.clusterTaskCounts[clusterID]++
+	}
+	info.key = key
+	i.tasks[key] = info
+	i.markTaskChanged(info)
+	i.buildClusters[buildID] = clusterID
+	if state == commonpb.IndexState_Failed {
+		evicted = i.retainFailedTask(ctx, key)
+	}
+	log.Info("IndexNode register terminal task", zap.String("clusterID", clusterID), zap.Int64("buildID", buildID),
+		zap.String("state", state.String()), zap.String("failReason", failReason))
+}
@@ -0,0 +1,114 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/milvus-io/milvus/pkg/metrics"
+	"github.com/milvus-io/milvus/pkg/util/paramtable"
+)
+
+const (
+	// maxRecentRegistrations bounds the registration times kept to compute the registration rate,
+	// the rate is underestimated if more tasks are registered within the window.
+	maxRecentRegistrations = 1024
+	// the window of the registration rate reported by metrics
+	registrationRateMetricWindow = time.Minute
+)
+
+// taskRegistrations is a ring of the recent registration times, the oldest one is overwritten once it's full.
+type taskRegistrations struct {
+	times []time.Time
+	next  int
+}
+
+func (r *taskRegistrations) add(t time.Time) {
+	if len(r.times) < maxRecentRegistrations {
+		r.times = append(r.times, t)
+		return
+	}
+	r.times[r.next] = t
+	r.next = (r.next + 1) % maxRecentRegistrations
+}
+
+// rate returns the registrations per second within the window until now.
+func (r *taskRegistrations) rate(now time.Time, window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	since := now.Add(-window)
+	count := 0
+	for _, t := range r.times {
+		if t.After(since) {
+			count++
+		}
+	}
+	return float64(count) / window.Seconds()
+}
+
+// recordRegistration records the registration of a task, and updates the registration metrics.
+// stateLock must be held by the caller.
+func (i *IndexNode) recordRegistration(info *taskInfo) {
+	now := i.clock.Now()
+	nodeID := strconv.FormatInt(paramtable.GetNodeID(), 10)
+	i.recentRegistrations.add(now)
+	metrics.IndexNodeTaskRegistrationRate.WithLabelValues(nodeID).
+		Set(i.recentRegistrations.rate(now, registrationRateMetricWindow))
+	buildType := metrics.NewIndexBuildLabel
+	if info.isRebuild {
+		buildType = metrics.RebuildIndexBuildLabel
+	}
+	metrics.IndexNodeRegisteredTaskCounter.WithLabelValues(nodeID, buildType).Inc()
+}
+
+// isRebuildAssignment returns whether the assignment of the build with indexVersion rebuilds an index
+// which this node finished with a lower index version. The coordinator increases the index version on every
+// assignment, the retries of the first build included, so the version alone doesn't tell a rebuild.
+// The finished versions are remembered by the tombstones of the deleted tasks, a build whose tombstone
+// is evicted is taken as a first build.
+func (i *IndexNode) isRebuildAssignment(key taskKey, indexVersion int64) bool {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	finished := i.tombstones.finishedIndexVersion(key)
+	return finished > 0 && indexVersion > finished
+}
+
+// rebuildVsNewCounts returns the number of the tasks rebuilding the index, and the number of the tasks
+// building the index for the first time.
+func (i *IndexNode) rebuildVsNewCounts() (rebuild, new int) {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	for _, info := range i.tasks {
+		if info.isRebuild {
+			rebuild++
+		} else {
+			new++
+		}
+	}
+	return rebuild, new
+}
+
+// registrationRate returns the tasks registered per second within the window,
+// only the recent maxRecentRegistrations registrations are counted.
+func (i *IndexNode) registrationRate(window time.Duration) float64 {
+	now := i.clock.Now()
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	return i.recentRegistrations.rate(now, window)
+}
@@ -0,0 +1,67 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+// indexTaskForSegment returns the task covering the segment, the task registered last wins
+// if the segment is covered by more than one task.
+func (i *IndexNode) indexTaskForSegment(segmentID int64) (taskKey, bool) {
+	i.stateLock.Lock()
+	defer i.stateLock.Unlock()
+	key, ok := i.segmentTasks[segmentID]
+	return key, ok
+}
+
+// untrackTaskSegments removes the segments of a deleted task from the segment index,
+// the segments still covered by other tasks are indexed to the one registered last of them.
+// stateLock must be held by the caller.
+func (i *IndexNode) untrackTaskSegments(key taskKey, info *taskInfo) {
+	for _, segmentID := range info.segmentIDs {
+		if i.segmentTasks[segmentID] != key {
+			continue
+		}
+		delete(i.segmentTasks, segmentID)
+		var latest *taskInfo
+		var latestKey taskKey
+		for otherKey, other := range i.tasks {
+			if !containsSegment(other, segmentID) {
+				continue
+			}
+			if latest == nil || registeredLater(otherKey, other, latestKey, latest) {
+				latest, latestKey = other, otherKey
+			}
+		}
+		if latest != nil {
+			i.segmentTasks[segmentID] = latestKey
+		}
+	}
+}
+
+func containsSegment(info *taskInfo, segmentID int64) bool {
+	for _, id := range info.segmentIDs {
+		if id == segmentID {
+			return true
+		}
+	}
+	return false
+}
+
+// registeredLater returns whether the task of key is registered after the task of otherKey,
+// the tasks registered at the same time are ordered by build ID.
+func registeredLater(key taskKey, info *taskInfo, otherKey taskKey, other *taskInfo) bool {
+	return info.createTime.After(other.createTime) ||
+		(info.createTime.Equal(other.createTime) && key.BuildID > otherKey.BuildID)
+}
@@ -0,0 +1,345 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/internal/proto/indexpb"
+)
+
+// IndexTaskSnapshot is a copy of an index task, it's safe to be used without holding any lock.
+// FileKeys are only a sample if the task has more than MaxDumpedIndexFileKeys keys, NumFileKeys counts all of them.
+type IndexTaskSnapshot struct {
+	ClusterID           string
+	BuildID             UniqueID
+	State               commonpb.IndexState
+	FailReason          string
+	Cancelled           bool
+	CancelReason        string
+	FileKeys            []string
+	NumFileKeys         int
+	SerializedSize      uint64
+	CurrentIndexVersion int32
+	IndexStoreVersion   int64
+	CreateTime          time.Time
+	StartTime           time.Time
+	WorkerID            string
+	ActualMem           uint64
+	EndTime             time.Time
+	StateChangedAt      time.Time
+	Statistic           *indexpb.JobInfo
+	Diagnostics         map[string]string
+}
+
+func (s IndexTaskSnapshot) key() taskKey {
+	return taskKey{ClusterID: s.ClusterID, BuildID: s.BuildID}
+}
+
+// newIndexTaskSnapshot copies the task, stateLock must be held by the caller.
+func newIndexTaskSnapshot(key taskKey, info *taskInfo) IndexTaskSnapshot {
+	snapshot := IndexTaskSnapshot{
+		ClusterID:           key.ClusterID,
+		BuildID:             key.BuildID,
+		State:               info.state,
+		FailReason:          info.failReason,
+		Cancelled:           info.cancelled,
+		CancelReason:        info.cancelReason,
+		FileKeys:            info.fileKeys.sample(Params.IndexNodeCfg.MaxDumpedIndexFileKeys.GetAsInt()),
+		NumFileKeys:         info.fileKeys.len(),
+		SerializedSize:      info.serializedSize,
+		CurrentIndexVersion: info.currentIndexVersion,
+		IndexStoreVersion:   info.indexStoreVersion,
+		CreateTime:          info.createTime,
+		StartTime:           info.startTime,
+		WorkerID:            info.workerID,
+		ActualMem:           info.actualMem,
+		EndTime:             info.endTime,
+		StateChangedAt:      info.stateChangedAt,
+		Diagnostics:         maps.Clone(info.diagnostics),
+	}
+	snapshot.Statistic, _ = cloneStatistic(key, info.statistic)
+	return snapshot
+}
+
+// lessTaskKey orders the tasks by cluster and build ID, it's shared by all the ordered views of the tasks.
+func lessTaskKey(a, b taskKey) bool {
+	if a.ClusterID != b.ClusterID {
+		return a.ClusterID < b.ClusterID
+	}
+	return a.BuildID < b.BuildID
+}
+
+func sortIndexTaskSnapshots(snapshots []IndexTaskSnapshot) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		return lessTaskKey(snapshots[i].key(), snapshots[j].key())
+	})
+}
+
+// indexTaskSnapshots returns the snapshots of all the index tasks, sorted by cluster and build ID.
+func (i *IndexNode) indexTaskSnapshots() []IndexTaskSnapshot {
+	i.stateLock.Lock()
+	snapshots := make([]IndexTaskSnapshot, 0, len(i.tasks))
+	for key, info := range i.tasks {
+		snapshots = append(snapshots, newIndexTaskSnapshot(key, info))
+	}
+	i.stateLock.Unlock()
+
+	sortIndexTaskSnapshots(snapshots)
+	return snapshots
+}
+
+// foreachTaskSnapshot calls fn with the snapshot of each task, ordered by cluster and build ID.
+// fn is called without holding stateLock, so it's free to retain the snapshots and to call the index node.
+func (i *IndexNode) foreachTaskSnapshot(fn func(IndexTaskSnapshot)) {
+	for _, snapshot := range i.indexTaskSnapshots() {
+		fn(snapshot)
+	}
+}
+
+// markTaskChanged stamps the task with a new generation and the time of the change,
+// stateLock must be held by the caller.
+func (i *IndexNode) markTaskChanged(info *taskInfo) {
+	i.generation++
+	info.generation = i.generation
+	info.stateChangedAt = i.clock.Now()
+}
+
+// tasksChangedSince returns the snapshots of the tasks registered or changing state after generation gen,
+// sorted by cluster and build ID, along with the current generation to be passed in the next poll.
+// The tasks deleted since gen are not reported.
+func (i *IndexNode) tasksChangedSince(gen uint64) ([]IndexTaskSnapshot, uint64) {
+	i.stateLock.Lock()
+	current := i.generation
+	snapshots := make([]IndexTaskSnapshot, 0)
+	for key, info := range i.tasks {
+		if info.generation > gen {
+			snapshots = append(snapshots, newIndexTaskSnapshot(key, info))
+		}
+	}
+	i.stateLock.Unlock()
+
+	sortIndexTaskSnapshots(snapshots)
+	return snapshots, current
+}
+
+// indexTasksByCluster returns the snapshots of the index tasks grouped by cluster, each group is sorted by build ID.
+func (i *IndexNode) indexTasksByCluster() map[string][]IndexTaskSnapshot {
+	i.stateLock.Lock()
+	groups := make(map[string][]IndexTaskSnapshot)
+	for key, info := range i.tasks {
+		groups[key.ClusterID] = append(groups[key.ClusterID], newIndexTaskSnapshot(key, info))
+	}
+	i.stateLock.Unlock()
+
+	for _, snapshots := range groups {
+		sortIndexTaskSnapshots(snapshots)
+	}
+	return groups
+}
+
+// indexTasksLargerThan returns the snapshots of the tasks whose serialized size exceeds bytes,
+// sorted by serialized size in descending order.
+func (i *IndexNode) indexTasksLargerThan(bytes uint64) []IndexTaskSnapshot {
+	i.stateLock.Lock()
+	snapshots := make([]IndexTaskSnapshot, 0)
+	for key, info := range i.tasks {
+		if info.serializedSize > bytes {
+			snapshots = append(snapshots, newIndexTaskSnapshot(key, info))
+		}
+	}
+	i.stateLock.Unlock()
+
+	sortIndexTaskSnapshots(snapshots)
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].SerializedSize > snapshots[j].SerializedSize
+	})
+	return snapshots
+}
+
+// pendingTaskSnapshots returns the snapshots of the queued or running tasks, sorted by cluster and build ID.
+func (i *IndexNode) pendingTaskSnapshots() []IndexTaskSnapshot {
+	i.stateLock.Lock()
+	snapshots := make([]IndexTaskSnapshot, 0)
+	for key, info := range i.tasks {
+		if isPendingTask(info) {
+			snapshots = append(snapshots, newIndexTaskSnapshot(key, info))
+		}
+	}
+	i.stateLock.Unlock()
+
+	sortIndexTaskSnapshots(snapshots)
+	return snapshots
+}
+
+// stuckNonTerminalTasks returns the snapshots of the tasks which stay in a non-terminal state longer than maxAge,
+// the age of a running task counts from its start, and the age of other tasks counts from registration.
+func (i *IndexNode) stuckNonTerminalTasks(maxAge time.Duration) []IndexTaskSnapshot {
+	now := i.clock.Now()
+	i.stateLock.Lock()
+	snapshots := make([]IndexTaskSnapshot, 0)
+	for key, info := range i.tasks {
+		if isTerminalState(info.state) {
+			continue
+		}
+		since := info.createTime
+		if info.state == commonpb.IndexState_InProgress && !info.startTime.IsZero() {
+			since = info.startTime
+		}
+		if now.Sub(since) > maxAge {
+			snapshots = append(snapshots, newIndexTaskSnapshot(key, info))
+		}
+	}
+	i.stateLock.Unlock()
+
+	sortIndexTaskSnapshots(snapshots)
+	return snapshots
+}
+
+// stagnantTasks returns the snapshots of the tasks whose state doesn't change for longer than maxAge, in any state.
+// Besides the stuck builds, it also surfaces the terminal tasks which should have been reaped.
+func (i *IndexNode) stagnantTasks(maxAge time.Duration) []IndexTaskSnapshot {
+	now := i.clock.Now()
+	i.stateLock.Lock()
+	snapshots := make([]IndexTaskSnapshot, 0)
+	for key, info := range i.tasks {
+		since := info.stateChangedAt
+		if since.IsZero() {
+			since = info.createTime
+		}
+		if now.Sub(since) > maxAge {
+			snapshots = append(snapshots, newIndexTaskSnapshot(key, info))
+		}
+	}
+	i.stateLock.Unlock()
+
+	sortIndexTaskSnapshots(snapshots)
+	return snapshots
+}
+
+// tasksSlowerThan returns the snapshots of the terminal tasks which ran longer than d, from start to end,
+// sorted by the execution time in descending order. The tasks never started are skipped.
+func (i *IndexNode) tasksSlowerThan(d time.Duration) []IndexTaskSnapshot {
+	i.stateLock.Lock()
+	snapshots := make([]IndexTaskSnapshot, 0)
+	for key, info := range i.tasks {
+		if !isTerminalState(info.state) || info.startTime.IsZero() || info.endTime.IsZero() {
+			continue
+		}
+		if info.endTime.Sub(info.startTime) > d {
+			snapshots = append(snapshots, newIndexTaskSnapshot(key, info))
+		}
+	}
+	i.stateLock.Unlock()
+
+	sortIndexTaskSnapshots(snapshots)
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].EndTime.Sub(snapshots[i].StartTime) > snapshots[j].EndTime.Sub(snapshots[j].StartTime)
+	})
+	return snapshots
+}
+
+// TaskStateChange is a task whose state is different between two snapshots.
+type TaskStateChange struct {
+	Before IndexTaskSnapshot
+	After  IndexTaskSnapshot
+}
+
+// TaskDiff is the difference between two lists of task snapshots.
+type TaskDiff struct {
+	Added        []IndexTaskSnapshot
+	Removed      []IndexTaskSnapshot
+	StateChanged []TaskStateChange
+}
+
+// DiffTaskSnapshots compares the task snapshots taken at two points in time,
+// the tasks in each category are sorted by cluster and build ID.
+func DiffTaskSnapshots(before, after []IndexTaskSnapshot) TaskDiff {
+	beforeTasks := make(map[taskKey]IndexTaskSnapshot, len(before))
+	for _, snapshot := range before {
+		beforeTasks[snapshot.key()] = snapshot
+	}
+
+	diff := TaskDiff{
+		Added:        make([]IndexTaskSnapshot, 0),
+		Removed:      make([]IndexTaskSnapshot, 0),
+		StateChanged: make([]TaskStateChange, 0),
+	}
+	afterKeys := make(map[taskKey]struct{}, len(after))
+	for _, snapshot := range after {
+		afterKeys[snapshot.key()] = struct{}{}
+		old, ok := beforeTasks[snapshot.key()]
+		if !ok {
+			diff.Added = append(diff.Added, snapshot)
+		} else if old.State != snapshot.State {
+			diff.StateChanged = append(diff.StateChanged, TaskStateChange{Before: old, After: snapshot})
+		}
+	}
+	for _, snapshot := range before {
+		if _, ok := afterKeys[snapshot.key()]; !ok {
+			diff.Removed = append(diff.Removed, snapshot)
+		}
+	}
+
+	sortIndexTaskSnapshots(diff.Added)
+	sortIndexTaskSnapshots(diff.Removed)
+	sort.Slice(diff.StateChanged, func(i, j int) bool {
+		return lessTaskKey(diff.StateChanged[i].After.key(), diff.StateChanged[j].After.key())
+	})
+	return diff
+}
+
+// streamIndexTasks calls fn with the snapshots of the index tasks in batches of batchSize,
+// ordered by cluster and build ID, until fn returns false or all the tasks are visited.
+// The lock is released between batches, so the stream is not a consistent view:
+// tasks registered after the stream starts are missed, and tasks deleted before their batch is taken are skipped.
+func (i *IndexNode) streamIndexTasks(batchSize int, fn func([]IndexTaskSnapshot) bool) {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	i.stateLock.Lock()
+	keys := make([]taskKey, 0, len(i.tasks))
+	for key := range i.tasks {
+		keys = append(keys, key)
+	}
+	i.stateLock.Unlock()
+	sort.Slice(keys, func(a, b int) bool {
+		return lessTaskKey(keys[a], keys[b])
+	})
+
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := make([]IndexTaskSnapshot, 0, end-start)
+		i.stateLock.Lock()
+		for _, key := range keys[start:end] {
+			if info, ok := i.tasks[key]; ok {
+				batch = append(batch, newIndexTaskSnapshot(key, info))
+			}
+		}
+		i.stateLock.Unlock()
+		if len(batch) > 0 && !fn(batch) {
+			return
+		}
+	}
+}
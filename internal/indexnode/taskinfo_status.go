@@ -0,0 +1,88 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/pkg/log"
+)
+
+// statusLine returns a one-line summary of the index node, e.g.
+// "index: 3 inprogress / 120 total, mem: 4.2GB, oldest: 7m0s", where mem is the resident memory reported
+// by the running builds, and oldest is how long the task running the longest has run.
+func (i *IndexNode) statusLine() string {
+	now := i.clock.Now()
+	i.stateLock.Lock()
+	inProgress := 0
+	mem := uint64(0)
+	oldest := time.Duration(0)
+	for _, info := range i.tasks {
+		if info.state != commonpb.IndexState_InProgress {
+			continue
+		}
+		inProgress++
+		mem += info.actualMem
+		since := info.startTime
+		if since.IsZero() {
+			since = info.createTime
+		}
+		if age := now.Sub(since); age > oldest {
+			oldest = age
+		}
+	}
+	total := len(i.tasks)
+	i.stateLock.Unlock()
+
+	return fmt.Sprintf("index: %d inprogress / %d total, mem: %s, oldest: %s",
+		inProgress, total, formatBytes(mem), oldest.Truncate(time.Second))
+}
+
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value := float64(bytes) / unit
+	for _, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f%s", value, suffix)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1fPB", value)
+}
+
+// statusLogLoop logs the status line every StatusLogInterval until the index node stops.
+func (i *IndexNode) statusLogLoop() {
+	interval := Params.IndexNodeCfg.StatusLogInterval.GetAsDuration(time.Second)
+	if interval <= 0 {
+		return
+	}
+	ticker := i.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.loopCtx.Done():
+			return
+		case <-ticker.C():
+			log.Info("IndexNode status: " + i.statusLine())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+)
+
+// taskTombstones remembers the recently deleted tasks, so that a late update of a deleted task
+// can be told apart from an update of a task which never existed, and a new assignment of a build
+// finished before can be told apart from a retry of its first build.
+// It's not thread safe, stateLock of the index node must be held.
+type taskTombstones struct {
+	deleted map[taskKey]*list.Element
+	// the keys ordered by delete time, the oldest is at the front
+	order *list.List
+}
+
+type taskTombstone struct {
+	key       taskKey
+	deletedAt time.Time
+	// the highest index version of the build finished by the deleted tasks, 0 if none finished
+	finishedIndexVersion int64
+}
+
+// finishedIndexVersion returns the index version of the task if it's finished, or 0 otherwise.
+func finishedIndexVersion(info *taskInfo) int64 {
+	if info.state != commonpb.IndexState_Finished {
+		return 0
+	}
+	return info.indexVersion
+}
+
+func newTaskTombstones() *taskTombstones {
+	return &taskTombstones{
+		deleted: make(map[taskKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// add records the deletion of the task, and evicts the oldest ones beyond capacity.
+// The finished index version of the tombstone being replaced is kept if it's higher.
+func (t *taskTombstones) add(key taskKey, deletedAt time.Time, finishedIndexVersion int64, capacity int) {
+	if elem, ok := t.deleted[key]; ok {
+		if previous := elem.Value.(*taskTombstone).finishedIndexVersion; previous > finishedIndexVersion {
+			finishedIndexVersion = previous
+		}
+		t.order.Remove(elem)
+		delete(t.deleted, key)
+	}
+	if capacity > 0 {
+		t.deleted[key] = t.order.PushBack(&taskTombstone{key: key, deletedAt: deletedAt, finishedIndexVersion: finishedIndexVersion})
+	}
+	for t.order.Len() > capacity {
+		oldest := t.order.Front()
+		t.order.Remove(oldest)
+		delete(t.deleted, oldest.Value.(*taskTombstone).key)
+	}
+}
+
+// get returns when the task was deleted if it's still remembered.
+func (t *taskTombstones) get(key taskKey) (time.Time, bool) {
+	elem, ok := t.deleted[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return elem.Value.(*taskTombstone).deletedAt, true
+}
+
+// finishedIndexVersion returns the highest index version of the build finished by the deleted tasks,
+// 0 if none finished or the task is not remembered.
+func (t *taskTombstones) finishedIndexVersion(key taskKey) int64 {
+	elem, ok := t.deleted[key]
+	if !ok {
+		return 0
+	}
+	return elem.Value.(*taskTombstone).finishedIndexVersion
+}
+
+func (t *taskTombstones) len() int {
+	return t.order.Len()
+}
@@ -0,0 +1,63 @@
+// Licensed to the LF AI & Data foundation under one
+// or more contributor license agreements. See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership. The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License. You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexnode
+
+import (
+	"context"
+
+	"github.com/milvus-io/milvus-proto/go-api/v2/commonpb"
+	"github.com/milvus-io/milvus/pkg/util/merr"
+)
+
+// notifyTaskWaiters wakes up the waiters of the task, stateLock must be held by the caller.
+func notifyTaskWaiters(info *taskInfo) {
+	if info.terminated != nil {
+		close(info.terminated)
+		info.terminated = nil
+	}
+}
+
+// waitForTaskTerminal blocks until the task reaches a terminal state, and returns the state.
+// It returns an error if the task doesn't exist or is deleted before reaching a terminal state, or ctx is done.
+func (i *IndexNode) waitForTaskTerminal(ctx context.Context, clusterID string, buildID UniqueID) (commonpb.IndexState, error) {
+	key := taskKey{ClusterID: clusterID, BuildID: buildID}
+	for {
+		i.stateLock.Lock()
+		info, ok := i.tasks[key]
+		if !ok {
+			i.stateLock.Unlock()
+			return commonpb.IndexState_IndexStateNone,
+				merr.WrapErrParameterInvalidMsg("index task not found, clusterID=%s, buildID=%d", clusterID, buildID)
+		}
+		if isTerminalState(info.state) {
+			state := info.state
+			i.stateLock.Unlock()
+			return state, nil
+		}
+		if info.terminated == nil {
+			info.terminated = make(chan struct{})
+		}
+		terminated := info.terminated
+		i.stateLock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return commonpb.IndexState_IndexStateNone, ctx.Err()
+		case <-terminated:
+		}
+	}
+}
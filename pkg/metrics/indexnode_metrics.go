@@ -96,6 +96,47 @@ var (
 			Help:      "latency of build index for segment",
 			Buckets:   indexBucket,
 		}, []string{nodeIDLabelName})
+
+	IndexNodeTaskFirstUpdateLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: milvusNamespace,
+			Subsystem: typeutil.IndexNodeRole,
+			Name:      "task_first_update_latency",
+			Help:      "latency from registering an index task to its first state update",
+			Buckets:   longTaskBuckets,
+		}, []string{nodeIDLabelName, clusterIDLabelName})
+
+	IndexNodeFinishedTaskStats = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: milvusNamespace,
+			Subsystem: typeutil.IndexNodeRole,
+			Name:      "finished_task_stats",
+			Help:      "statistics of the latest finished index task per cluster",
+		}, []string{nodeIDLabelName, clusterIDLabelName, jobStatLabelName})
+
+	IndexNodeCancelledTaskRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: milvusNamespace,
+			Subsystem: typeutil.IndexNodeRole,
+			Name:      "cancelled_task_ratio",
+			Help:      "ratio of cancelled index tasks to the index tasks reaching a terminal state",
+		}, []string{nodeIDLabelName, clusterIDLabelName})
+
+	IndexNodeRegisteredTaskCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: milvusNamespace,
+			Subsystem: typeutil.IndexNodeRole,
+			Name:      "registered_task_count",
+			Help:      "number of index tasks registered, by whether they build the index for the first time or rebuild it",
+		}, []string{nodeIDLabelName, buildTypeLabelName})
+
+	IndexNodeTaskRegistrationRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: milvusNamespace,
+			Subsystem: typeutil.IndexNodeRole,
+			Name:      "task_registration_rate",
+			Help:      "index tasks registered per second over the last minute",
+		}, []string{nodeIDLabelName})
 )
 
 // RegisterIndexNode registers IndexNode metrics
@@ -108,4 +149,9 @@ func RegisterIndexNode(registry *prometheus.Registry) {
 	registry.MustRegister(IndexNodeSaveIndexFileLatency)
 	registry.MustRegister(IndexNodeIndexTaskLatencyInQueue)
 	registry.MustRegister(IndexNodeBuildIndexLatency)
+	registry.MustRegister(IndexNodeTaskFirstUpdateLatency)
+	registry.MustRegister(IndexNodeFinishedTaskStats)
+	registry.MustRegister(IndexNodeCancelledTaskRatio)
+	registry.MustRegister(IndexNodeTaskRegistrationRate)
+	registry.MustRegister(IndexNodeRegisteredTaskCounter)
 }
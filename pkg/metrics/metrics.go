@@ -49,6 +49,9 @@ const (
 	FailedIndexTaskLabel     = "failed"
 	RecycledIndexTaskLabel   = "recycled"
 
+	NewIndexBuildLabel     = "new"
+	RebuildIndexBuildLabel = "rebuild"
+
 	// Note: below must matchcommonpb.SegmentState_name fields.
 	SealedSegmentLabel   = "Sealed"
 	GrowingSegmentLabel  = "Growing"
@@ -105,6 +108,9 @@ const (
 	lockType                 = "lock_type"
 	lockOp                   = "lock_op"
 	loadTypeName             = "load_type"
+	clusterIDLabelName       = "cluster_id"
+	jobStatLabelName         = "job_stat"
+	buildTypeLabelName       = "build_type"
 
 	// entities label
 	LoadedLabel         = "loaded"
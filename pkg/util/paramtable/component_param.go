@@ -3692,6 +3692,23 @@ type indexNodeConfig struct {
 	MaxDiskUsagePercentage ParamItem `refreshable:"true"`
 
 	GracefulStopTimeout ParamItem `refreshable:"true"`
+
+	MaxClusterSerializedSize         ParamItem `refreshable:"true"`
+	StateChangeLogRate               ParamItem `refreshable:"true"`
+	TaskCleanupParallel              ParamItem `refreshable:"true"`
+	TaskTombstoneCapacity            ParamItem `refreshable:"true"`
+	MaxRetainedFailedTasksPerCluster ParamItem `refreshable:"true"`
+	QuarantineFailureThreshold       ParamItem `refreshable:"true"`
+	QuarantineCooldown               ParamItem `refreshable:"true"`
+	MaxDumpedIndexFileKeys           ParamItem `refreshable:"true"`
+	MaxSerializedSizePerTask         ParamItem `refreshable:"true"`
+	ReadyMaxPendingTasks             ParamItem `refreshable:"true"`
+	ResetInProgressTaskPolicy        ParamItem `refreshable:"true"`
+	TaskDeletionWaitTimeout          ParamItem `refreshable:"true"`
+	StatusLogInterval                ParamItem `refreshable:"false"`
+	FailFinishedTaskWithoutFiles     ParamItem `refreshable:"true"`
+	MaxDistinctClusters              ParamItem `refreshable:"true"`
+	RejectClustersOverLimit          ParamItem `refreshable:"true"`
 }
 
 func (p *indexNodeConfig) init(base *BaseTable) {
@@ -3749,6 +3766,138 @@ func (p *indexNodeConfig) init(base *BaseTable) {
 		Doc:          "seconds. force stop node without graceful stop",
 	}
 	p.GracefulStopTimeout.Init(base.mgr)
+
+	p.MaxClusterSerializedSize = ParamItem{
+		Key:          "indexNode.maxClusterSerializedSize",
+		Version:      "2.4.1",
+		DefaultValue: "0",
+		Doc:          "bytes. max total serialized size of the index files tracked for one cluster, 0 means unlimited",
+	}
+	p.MaxClusterSerializedSize.Init(base.mgr)
+
+	p.StateChangeLogRate = ParamItem{
+		Key:          "indexNode.stateChangeLogRate",
+		Version:      "2.4.1",
+		DefaultValue: "10",
+		Doc:          "max number of task state change logs per second for one cluster, 0 means no limit",
+	}
+	p.StateChangeLogRate.Init(base.mgr)
+
+	p.TaskCleanupParallel = ParamItem{
+		Key:          "indexNode.taskCleanupParallel",
+		Version:      "2.4.1",
+		DefaultValue: "4",
+		Doc:          "max number of concurrent cleanup hooks of the deleted tasks",
+	}
+	p.TaskCleanupParallel.Init(base.mgr)
+
+	p.TaskTombstoneCapacity = ParamItem{
+		Key:          "indexNode.taskTombstoneCapacity",
+		Version:      "2.4.1",
+		DefaultValue: "1024",
+		Doc:          "number of recently deleted tasks remembered to detect late updates, 0 means disabled",
+	}
+	p.TaskTombstoneCapacity.Init(base.mgr)
+
+	p.MaxRetainedFailedTasksPerCluster = ParamItem{
+		Key:          "indexNode.maxRetainedFailedTasksPerCluster",
+		Version:      "2.4.1",
+		DefaultValue: "0",
+		Doc:          "max number of failed tasks retained per cluster, the oldest failed task is dropped beyond it, 0 means no limit",
+	}
+	p.MaxRetainedFailedTasksPerCluster.Init(base.mgr)
+
+	p.QuarantineFailureThreshold = ParamItem{
+		Key:          "indexNode.quarantineFailureThreshold",
+		Version:      "2.4.1",
+		DefaultValue: "0",
+		Doc:          "number of consecutive failures with the same reason before a build is quarantined, 0 means disabled",
+	}
+	p.QuarantineFailureThreshold.Init(base.mgr)
+
+	p.QuarantineCooldown = ParamItem{
+		Key:          "indexNode.quarantineCooldown",
+		Version:      "2.4.1",
+		DefaultValue: "600",
+		Doc:          "seconds a quarantined build is refused before it can be registered again, the failures of a build apart longer than it are not counted as consecutive",
+	}
+	p.QuarantineCooldown.Init(base.mgr)
+
+	p.MaxDumpedIndexFileKeys = ParamItem{
+		Key:          "indexNode.maxDumpedIndexFileKeys",
+		Version:      "2.4.1",
+		DefaultValue: "0",
+		Doc: `max number of index file keys per task in the dumps and logs, only a sample of the keys and their count are reported beyond it,
+0 means no limit. All the keys are retained and reported to the coordinator`,
+	}
+	p.MaxDumpedIndexFileKeys.Init(base.mgr)
+
+	p.MaxSerializedSizePerTask = ParamItem{
+		Key:          "indexNode.maxSerializedSizePerTask",
+		Version:      "2.4.1",
+		DefaultValue: "0",
+		Doc:          "bytes. max serialized size of the index files of one task, the task exceeding it fails, 0 means unlimited",
+	}
+	p.MaxSerializedSizePerTask.Init(base.mgr)
+
+	p.ReadyMaxPendingTasks = ParamItem{
+		Key:          "indexNode.readyMaxPendingTasks",
+		Version:      "2.4.1",
+		DefaultValue: "0",
+		Doc:          "the index node reports not ready while it has more pending index tasks than this, 0 means no limit",
+	}
+	p.ReadyMaxPendingTasks.Init(base.mgr)
+
+	p.ResetInProgressTaskPolicy = ParamItem{
+		Key:          "indexNode.resetInProgressTaskPolicy",
+		Version:      "2.4.1",
+		DefaultValue: "cancel",
+		Doc: `how the in-progress tasks are handled when all the tasks are reset on stop,
+cancel: cancel them, wait: wait for them until the graceful stop timeout and cancel the rest,
+drop: drop them without cancelling, which leaves their builds running and is meant for tests only`,
+	}
+	p.ResetInProgressTaskPolicy.Init(base.mgr)
+
+	p.TaskDeletionWaitTimeout = ParamItem{
+		Key:          "indexNode.taskDeletionWaitTimeout",
+		Version:      "2.4.1",
+		DefaultValue: "0",
+		Doc: `milliseconds the registration of an index task waits for the cleanup of the deleted task with the same key,
+the registration is rejected as busy if the cleanup is not done in time, 0 means not to wait`,
+	}
+	p.TaskDeletionWaitTimeout.Init(base.mgr)
+
+	p.StatusLogInterval = ParamItem{
+		Key:          "indexNode.statusLogInterval",
+		Version:      "2.4.1",
+		DefaultValue: "60",
+		Doc:          "seconds between the logs of the one-line status of the index node, 0 means not to log",
+	}
+	p.StatusLogInterval.Init(base.mgr)
+
+	p.FailFinishedTaskWithoutFiles = ParamItem{
+		Key:          "indexNode.failFinishedTaskWithoutFiles",
+		Version:      "2.4.1",
+		DefaultValue: "false",
+		Doc:          "whether to fail the index task finishing without any index file, it's logged as an error either way",
+	}
+	p.FailFinishedTaskWithoutFiles.Init(base.mgr)
+
+	p.MaxDistinctClusters = ParamItem{
+		Key:          "indexNode.maxDistinctClusters",
+		Version:      "2.4.1",
+		DefaultValue: "0",
+		Doc:          "soft limit of the distinct clusters having tasks on the index node, a warning is logged when a new cluster exceeds it, 0 means no limit",
+	}
+	p.MaxDistinctClusters.Init(base.mgr)
+
+	p.RejectClustersOverLimit = ParamItem{
+		Key:          "indexNode.rejectClustersOverLimit",
+		Version:      "2.4.1",
+		DefaultValue: "false",
+		Doc:          "whether to reject the tasks of a new cluster exceeding maxDistinctClusters instead of only logging a warning",
+	}
+	p.RejectClustersOverLimit.Init(base.mgr)
 }
 
 type runtimeConfig struct {
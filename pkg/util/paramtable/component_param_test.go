@@ -485,6 +485,23 @@ func TestComponentParam(t *testing.T) {
 
 		params.Save("indexnode.gracefulStopTimeout", "100")
 		assert.Equal(t, 100*time.Second, Params.GracefulStopTimeout.GetAsDuration(time.Second))
+
+		assert.Equal(t, uint64(0), Params.MaxClusterSerializedSize.GetAsUint64())
+		assert.Equal(t, 10.0, Params.StateChangeLogRate.GetAsFloat())
+		assert.Equal(t, 4, Params.TaskCleanupParallel.GetAsInt())
+		assert.Equal(t, 1024, Params.TaskTombstoneCapacity.GetAsInt())
+		assert.Equal(t, 0, Params.MaxRetainedFailedTasksPerCluster.GetAsInt())
+		assert.Equal(t, 0, Params.QuarantineFailureThreshold.GetAsInt())
+		assert.Equal(t, 600*time.Second, Params.QuarantineCooldown.GetAsDuration(time.Second))
+		assert.Equal(t, 0, Params.MaxDumpedIndexFileKeys.GetAsInt())
+		assert.Equal(t, uint64(0), Params.MaxSerializedSizePerTask.GetAsUint64())
+		assert.Equal(t, 0, Params.ReadyMaxPendingTasks.GetAsInt())
+		assert.Equal(t, "cancel", Params.ResetInProgressTaskPolicy.GetValue())
+		assert.Equal(t, 0, Params.TaskDeletionWaitTimeout.GetAsInt())
+		assert.Equal(t, 60*time.Second, Params.StatusLogInterval.GetAsDuration(time.Second))
+		assert.False(t, Params.FailFinishedTaskWithoutFiles.GetAsBool())
+		assert.Equal(t, 0, Params.MaxDistinctClusters.GetAsInt())
+		assert.False(t, Params.RejectClustersOverLimit.GetAsBool())
 	})
 
 	t.Run("channel config priority", func(t *testing.T) {